@@ -0,0 +1,285 @@
+package basicstation
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// DefaultEUIRate and DefaultEUIBurst limit the connection attempts of a
+	// gateway, discovery and muxs connections alike
+	DefaultEUIRate  = 0.2
+	DefaultEUIBurst = 5
+
+	// DefaultIPRate and DefaultIPBurst limit the connection attempts from an
+	// address, which may be shared by many gateways behind NAT
+	DefaultIPRate  = 5
+	DefaultIPBurst = 20
+
+	// DefaultSessionRetryAfter is the backoff hint when all sessions are taken
+	DefaultSessionRetryAfter = 30 * time.Second
+
+	// bucketSweepInterval is how often idle buckets are dropped
+	bucketSweepInterval = time.Minute
+)
+
+// Rejection reasons of AdmissionStats
+const (
+	RejectEUIRate      = "eui_rate"
+	RejectIPRate       = "ip_rate"
+	RejectSessionLimit = "session_limit"
+)
+
+// Rejection error tells a station to back off
+type Rejection struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+// Error satisifies error interface
+func (r Rejection) Error() string {
+	return fmt.Sprintf("connection rejected: %s, retry after %v", r.Reason, r.RetryAfter)
+}
+
+// status returns the HTTP status answering the rejection
+func (r Rejection) status() int {
+	if r.Reason == RejectSessionLimit {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusTooManyRequests
+}
+
+// retryAfterSeconds rounds the backoff hint up to whole seconds
+func (r Rejection) retryAfterSeconds() int {
+	return int(math.Ceil(r.RetryAfter.Seconds()))
+}
+
+// AdmissionStats counts the rejected connection attempts by reason and the
+// admitted gateway sessions
+type AdmissionStats struct {
+	EUIRate      uint64
+	IPRate       uint64
+	SessionLimit uint64
+	Sessions     int
+}
+
+// Admission limits connection attempts with a token bucket per remote
+// address and per gateway EUI, and caps the number of concurrent gateway
+// sessions. The address and session limits apply before authentication, the
+// EUI is only charged once the gateway authenticated. Rates are attempts per
+// second, a zero rate disables the limit.
+type Admission struct {
+	EUIRate  float64
+	EUIBurst int
+	IPRate   float64
+	IPBurst  int
+
+	// MaxSessions caps concurrent gateway sessions, 0 is unlimited
+	MaxSessions int
+
+	// SessionRetryAfter is the backoff hint of the session limit
+	SessionRetryAfter time.Duration
+
+	mu        sync.Mutex
+	euis      map[uint64]*bucket
+	ips       map[string]*bucket
+	sessions  int
+	lastSweep time.Time
+	rejected  AdmissionStats
+}
+
+// NewAdmission returns admission control with the default limits and at
+// most maxSessions concurrent gateway sessions
+func NewAdmission(maxSessions int) *Admission {
+	return &Admission{
+		EUIRate:           DefaultEUIRate,
+		EUIBurst:          DefaultEUIBurst,
+		IPRate:            DefaultIPRate,
+		IPBurst:           DefaultIPBurst,
+		MaxSessions:       maxSessions,
+		SessionRetryAfter: DefaultSessionRetryAfter,
+	}
+}
+
+// bucket is a token bucket refilled at rate tokens per second
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token, or returns how long until one is available
+func (b *bucket) take(rate float64, burst int, now time.Time) (time.Duration, bool) {
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second)), false
+}
+
+// full reports whether the bucket refilled, so dropping it changes nothing
+func (b *bucket) full(rate float64, burst int, now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*rate >= float64(burst)
+}
+
+// Stats returns the rejection counts and the number of sessions
+func (a *Admission) Stats() AdmissionStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stats := a.rejected
+	stats.Sessions = a.sessions
+
+	return stats
+}
+
+// admitIP takes a token from the bucket of a remote address
+func (a *Admission) admitIP(ip string) error {
+	if a.IPRate <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.sweep(now)
+
+	if a.ips == nil {
+		a.ips = make(map[string]*bucket)
+	}
+	b, ok := a.ips[ip]
+	if !ok {
+		b = &bucket{tokens: float64(a.IPBurst), last: now}
+		a.ips[ip] = b
+	}
+
+	if wait, ok := b.take(a.IPRate, a.IPBurst, now); !ok {
+		a.rejected.IPRate++
+		return Rejection{Reason: RejectIPRate, RetryAfter: wait}
+	}
+	return nil
+}
+
+// admitEUI takes a token from the bucket of a gateway
+func (a *Admission) admitEUI(eui uint64) error {
+	if a.EUIRate <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.sweep(now)
+
+	if a.euis == nil {
+		a.euis = make(map[uint64]*bucket)
+	}
+	b, ok := a.euis[eui]
+	if !ok {
+		b = &bucket{tokens: float64(a.EUIBurst), last: now}
+		a.euis[eui] = b
+	}
+
+	if wait, ok := b.take(a.EUIRate, a.EUIBurst, now); !ok {
+		a.rejected.EUIRate++
+		return Rejection{Reason: RejectEUIRate, RetryAfter: wait}
+	}
+	return nil
+}
+
+// admitSession reserves a gateway session, release frees it
+func (a *Admission) admitSession() (release func(), err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.MaxSessions > 0 && a.sessions >= a.MaxSessions {
+		a.rejected.SessionLimit++
+
+		retry := a.SessionRetryAfter
+		if retry <= 0 {
+			retry = DefaultSessionRetryAfter
+		}
+		return nil, Rejection{Reason: RejectSessionLimit, RetryAfter: retry}
+	}
+	a.sessions++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mu.Lock()
+			a.sessions--
+			a.mu.Unlock()
+		})
+	}, nil
+}
+
+// admitGateway admits a muxs connection attempt by its address and the
+// session limit. The claimed EUI is not charged here, see admitEUI.
+func (a *Admission) admitGateway(r *http.Request) (release func(), err error) {
+	if err := a.admitIP(remoteIP(r)); err != nil {
+		return nil, err
+	}
+	return a.admitSession()
+}
+
+// sweep drops the buckets that refilled, a must be locked
+func (a *Admission) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < bucketSweepInterval {
+		return
+	}
+	a.lastSweep = now
+
+	for ip, b := range a.ips {
+		if b.full(a.IPRate, a.IPBurst, now) {
+			delete(a.ips, ip)
+		}
+	}
+	for eui, b := range a.euis {
+		if b.full(a.EUIRate, a.EUIBurst, now) {
+			delete(a.euis, eui)
+		}
+	}
+}
+
+// remoteIP returns the address of the connecting peer. Proxy headers are
+// not trusted, a station could claim any address with them.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// reject answers a refused connection attempt with a backoff hint
+func reject(w http.ResponseWriter, rej Rejection) {
+	w.Header().Set("Retry-After", strconv.Itoa(rej.retryAfterSeconds()))
+	http.Error(w, rej.Reason, rej.status())
+}
+
+// rejected starts the log event of a refused connection attempt
+func (env *Environment) rejected(rej Rejection, r *http.Request) *zerolog.Event {
+	stats := env.Admission.Stats()
+
+	return env.Log.Warn().
+		Str("reason", rej.Reason).
+		Str("remote", r.RemoteAddr).
+		Dur("retry_after", rej.RetryAfter).
+		Uint64("rejected_eui_rate", stats.EUIRate).
+		Uint64("rejected_ip_rate", stats.IPRate).
+		Uint64("rejected_session_limit", stats.SessionLimit)
+}
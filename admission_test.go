@@ -0,0 +1,204 @@
+package basicstation
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// newAdmissionServer starts a station server admitting connections with adm
+func newAdmissionServer(rs *recordingServer, adm *Admission) *httptest.Server {
+	rs.conf = newRouterConf()
+
+	router := mux.NewRouter()
+	router.Handle("/{eui}", GatewayHandler{Env: &Environment{Server: rs, Admission: adm}})
+
+	return httptest.NewServer(router)
+}
+
+// expectRejected dials url and checks the upgrade is refused with status
+func expectRejected(t *testing.T, url string, status int, retryAfter string) {
+	t.Helper()
+
+	ws, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		ws.Close()
+		t.Fatalf("dial %s succeeded, want status %d", url, status)
+	}
+	if resp == nil {
+		t.Fatalf("dial %s got %v, want status %d", url, err, status)
+	}
+	if resp.StatusCode != status {
+		t.Errorf("status got %d, want %d", resp.StatusCode, status)
+	}
+	if got := resp.Header.Get("Retry-After"); got != retryAfter {
+		t.Errorf("Retry-After got %q, want %q", got, retryAfter)
+	}
+}
+
+func TestAdmissionEUIRate(t *testing.T) {
+
+	adm := &Admission{EUIRate: 0.1, EUIBurst: 2}
+
+	rs := newRecordingServer()
+	s := newAdmissionServer(rs, adm)
+	defer s.Close()
+
+	for i := 0; i < 2; i++ {
+		ws := dialStation(t, s, "0000000000000001")
+		<-rs.gws
+		ws.Close()
+	}
+
+	url := "ws" + strings.TrimPrefix(s.URL, "http")
+	expectRejected(t, url+"/0000000000000001", http.StatusTooManyRequests, "10")
+
+	// Other gateways have their own bucket
+	ws := dialStation(t, s, "0000000000000002")
+	<-rs.gws
+	ws.Close()
+
+	if got := adm.Stats().EUIRate; got != 1 {
+		t.Errorf("eui rate rejections got %d, want 1", got)
+	}
+}
+
+func TestAdmissionSessionLimit(t *testing.T) {
+
+	adm := NewAdmission(1)
+	adm.EUIRate = 0
+	adm.IPRate = 0
+
+	rs := newRecordingServer()
+	s := newAdmissionServer(rs, adm)
+	defer s.Close()
+
+	ws := dialStation(t, s, "0000000000000001")
+	<-rs.gws
+
+	url := "ws" + strings.TrimPrefix(s.URL, "http")
+	expectRejected(t, url+"/0000000000000002", http.StatusServiceUnavailable, "30")
+
+	ws.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for adm.Stats().Sessions != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("session not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ws = dialStation(t, s, "0000000000000002")
+	<-rs.gws
+	ws.Close()
+
+	if stats := adm.Stats(); stats.SessionLimit != 1 {
+		t.Errorf("session limit rejections got %d, want 1", stats.SessionLimit)
+	}
+}
+
+func TestAdmissionDiscovery(t *testing.T) {
+
+	t.Run("ip rate", func(t *testing.T) {
+		adm := &Admission{IPRate: 0.5, IPBurst: 1}
+		env := &Environment{Server: testServer{}, Admission: adm}
+
+		s, ws := newDiscoveryWSServer(t, DiscoveryHandler{Env: env})
+		defer s.Close()
+		defer ws.Close()
+
+		expectRejected(t, "ws"+strings.TrimPrefix(s.URL, "http"), http.StatusTooManyRequests, "2")
+
+		if got := adm.Stats().IPRate; got != 1 {
+			t.Errorf("ip rate rejections got %d, want 1", got)
+		}
+	})
+
+	t.Run("eui rate", func(t *testing.T) {
+		adm := &Admission{EUIRate: 0.25, EUIBurst: 1}
+		ts := testServer{}
+		ts.discovery = DiscoveryResponse{URI: "ws://discovery-test.com:8080/0000000000000001"}
+		env := &Environment{Server: ts, Admission: adm}
+
+		for i, want := range []string{"", "eui_rate, retry after 4 s"} {
+			s, ws := newDiscoveryWSServer(t, DiscoveryHandler{Env: env})
+
+			sendMessage(t, ws, map[string]interface{}{"router": 1})
+
+			var reply DiscoveryResponse
+			receiveWSMessage(t, ws, &reply)
+			if reply.Error != want {
+				t.Errorf("request %d error got %q, want %q", i, reply.Error, want)
+			}
+
+			if want != "" {
+				_, _, err := ws.ReadMessage()
+				if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+					t.Errorf("close got %v, want code %d", err, websocket.CloseTryAgainLater)
+				}
+			}
+
+			ws.Close()
+			s.Close()
+		}
+	})
+}
+
+func TestAdmissionSpoofedEUI(t *testing.T) {
+
+	ta, err := LoadTokenFile(writeTokenFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adm := &Admission{EUIRate: 0.1, EUIBurst: 1}
+
+	rs := newRecordingServer()
+	rs.conf = newRouterConf()
+	router := mux.NewRouter()
+	router.Handle("/{eui}", GatewayHandler{Env: &Environment{Server: rs, Admission: adm}, Auth: ta})
+	s := httptest.NewServer(router)
+	defer s.Close()
+
+	url := "ws" + strings.TrimPrefix(s.URL, "http") + "/0000000000000001"
+
+	// Failed attempts with the EUI of the gateway do not use up its bucket
+	for i := 0; i < 3; i++ {
+		expectRejected(t, url, http.StatusUnauthorized, "")
+	}
+
+	header := http.Header{"Authorization": {"Bearer secret"}}
+	ws, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("authenticated gateway locked out: %v", err)
+	}
+	ws.Close()
+	<-rs.gws
+
+	if got := adm.Stats().EUIRate; got != 0 {
+		t.Errorf("eui rate rejections got %d, want 0", got)
+	}
+}
+
+func TestAdmissionSweep(t *testing.T) {
+
+	// No address limit, the gateway buckets are swept all the same
+	adm := &Admission{EUIRate: 1000, EUIBurst: 1}
+	for eui := uint64(1); eui <= 100; eui++ {
+		adm.admitEUI(eui)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	adm.lastSweep = time.Time{}
+	adm.admitEUI(1000)
+
+	if len(adm.euis) != 1 {
+		t.Errorf("%d gateway buckets after sweep, want 1", len(adm.euis))
+	}
+}
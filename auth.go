@@ -0,0 +1,175 @@
+package basicstation
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrUnauthorized is returned by an Authenticator when the station sent
+	// no or invalid credentials, it is answered with 401 Unauthorized
+	ErrUnauthorized = errors.New("missing or invalid credentials")
+
+	// ErrForbidden is returned by an Authenticator when the credentials are
+	// not valid for the gateway, it is answered with 403 Forbidden
+	ErrForbidden = errors.New("gateway not allowed")
+)
+
+// Identity is the authenticated identity of a station
+type Identity struct {
+	// EUI the credentials were issued for
+	EUI uint64
+
+	// Name describes the credentials, such as a token label
+	Name string
+
+	// Method is the authentication method, such as "token" or "mtls"
+	Method string
+}
+
+// Authenticator checks the credentials of a station connecting as eui
+// before its websocket is upgraded. It returns ErrUnauthorized or
+// ErrForbidden, possibly wrapped, to refuse the station.
+type Authenticator interface {
+	Authenticate(eui uint64, r *http.Request) (Identity, error)
+}
+
+// authenticate runs the authenticator, answering the request if it fails
+func authenticate(auth Authenticator, eui uint64, w http.ResponseWriter, r *http.Request) (Identity, error) {
+	id, err := auth.Authenticate(eui, r)
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrUnauthorized):
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	case errors.Is(err, ErrForbidden):
+		http.Error(w, "forbidden", http.StatusForbidden)
+	default:
+		http.Error(w, "server error", http.StatusInternalServerError)
+	}
+
+	return id, err
+}
+
+// bearerToken returns the token of the Authorization header. Stations send
+// the header from tc.key as is, with or without the Bearer scheme.
+func bearerToken(r *http.Request) string {
+	token := strings.TrimSpace(r.Header.Get("Authorization"))
+	if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") {
+		token = strings.TrimSpace(token[7:])
+	}
+	return token
+}
+
+// maxTokenLength is the longest token bcrypt compares in full, it ignores
+// any further bytes
+const maxTokenLength = 72
+
+// dummyHash is compared against for gateways without a token, so unknown and
+// provisioned gateways take as long to refuse
+var dummyHash = []byte("$2a$10$HGbo12N/xGCwd3/uUfRacOWCA/vNO2LoC3XQPJr5pmuiz/zBT3aW.")
+
+// TokenAuthenticator authenticates stations by the bcrypt hash of their
+// token. The token file has one "<eui> <bcrypt hash> [name]" line per
+// gateway, blank lines and lines starting with # are ignored. Tokens are
+// at most 72 bytes long, longer ones are refused as bcrypt would only check
+// their first 72 bytes.
+type TokenAuthenticator struct {
+	path string
+
+	mu     sync.RWMutex
+	tokens map[uint64]tokenEntry
+}
+
+type tokenEntry struct {
+	hash []byte
+	name string
+}
+
+// LoadTokenFile returns an authenticator using the token file at path
+func LoadTokenFile(path string) (*TokenAuthenticator, error) {
+	ta := &TokenAuthenticator{path: path}
+	if err := ta.Reload(); err != nil {
+		return nil, err
+	}
+	return ta, nil
+}
+
+// Reload reads the token file again, the old tokens stay in use if it fails
+func (ta *TokenAuthenticator) Reload() error {
+	f, err := os.Open(ta.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tokens := make(map[uint64]tokenEntry)
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return fmt.Errorf("%s:%d: want <eui> <bcrypt hash> [name]", ta.path, n)
+		}
+
+		id, err := ParseRouterID(fields[0])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", ta.path, n, err)
+		}
+		if _, err := bcrypt.Cost([]byte(fields[1])); err != nil {
+			return fmt.Errorf("%s:%d: %v", ta.path, n, err)
+		}
+
+		entry := tokenEntry{hash: []byte(fields[1])}
+		if len(fields) == 3 {
+			entry.name = fields[2]
+		}
+		tokens[id.EUI] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	ta.mu.Lock()
+	ta.tokens = tokens
+	ta.mu.Unlock()
+
+	return nil
+}
+
+// Authenticate checks the Authorization header token of the station
+func (ta *TokenAuthenticator) Authenticate(eui uint64, r *http.Request) (Identity, error) {
+	token := bearerToken(r)
+	if token == "" || len(token) > maxTokenLength {
+		return Identity{}, ErrUnauthorized
+	}
+
+	ta.mu.RLock()
+	entry, ok := ta.tokens[eui]
+	ta.mu.RUnlock()
+
+	// Gateways without a token are refused like a wrong token, not telling
+	// which gateways are provisioned
+	hash := entry.hash
+	if !ok {
+		hash = dummyHash
+	}
+
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(token)); err != nil || !ok {
+		return Identity{}, ErrUnauthorized
+	}
+
+	return Identity{EUI: eui, Name: entry.name, Method: "token"}, nil
+}
@@ -0,0 +1,147 @@
+package basicstation
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeTokenFile writes a token file for gateway 1 with token secret
+func writeTokenFile(t *testing.T) string {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "tokens")
+	content := fmt.Sprintf("# gateway tokens\n\n::1 %s rooftop\n", hash)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+
+	ta, err := LoadTokenFile(writeTokenFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs := newRecordingServer()
+	rs.conf = newRouterConf()
+	router := mux.NewRouter()
+	router.Handle("/{eui}", GatewayHandler{Env: &Environment{Server: rs}, Auth: ta})
+	s := httptest.NewServer(router)
+	defer s.Close()
+
+	base := "ws" + strings.TrimPrefix(s.URL, "http") + "/"
+
+	tcs := []struct {
+		name   string
+		eui    string
+		auth   string
+		status int
+	}{
+		{"bearer token", "0000000000000001", "Bearer secret", http.StatusSwitchingProtocols},
+		{"raw token", "::1", "secret", http.StatusSwitchingProtocols},
+		{"no token", "0000000000000001", "", http.StatusUnauthorized},
+		{"wrong token", "0000000000000001", "Bearer guess", http.StatusUnauthorized},
+		{"unknown gateway", "0000000000000002", "Bearer secret", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tcs {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.auth != "" {
+				header.Set("Authorization", tt.auth)
+			}
+
+			ws, resp, err := websocket.DefaultDialer.Dial(base+tt.eui, header)
+			if resp == nil || resp.StatusCode != tt.status {
+				t.Fatalf("dial got %v, %v, want status %d", resp, err, tt.status)
+			}
+			if err != nil {
+				return
+			}
+			defer ws.Close()
+
+			sendMessage(t, ws, map[string]interface{}{"msgtype": "version", "protocol": 2})
+			var conf RouterConf
+			receiveWSMessage(t, ws, &conf)
+
+			gw := <-rs.gws
+			want := Identity{EUI: 1, Name: "rooftop", Method: "token"}
+			if gw.Identity != want {
+				t.Errorf("identity got %+v, want %+v", gw.Identity, want)
+			}
+		})
+	}
+}
+
+func TestTokenAuthenticatorLength(t *testing.T) {
+
+	token := strings.Repeat("x", maxTokenLength)
+	hash, err := bcrypt.GenerateFromPassword([]byte(token), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := ioutil.WriteFile(path, []byte(fmt.Sprintf("::1 %s\n", hash)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ta, err := LoadTokenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		token string
+		ok    bool
+	}{
+		{token, true},
+		{token + "y", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+tt.token)
+
+		_, err := ta.Authenticate(1, r)
+		if tt.ok && err != nil {
+			t.Errorf("%d byte token: %v", len(tt.token), err)
+		}
+		if !tt.ok && !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("%d byte token got %v, want %v", len(tt.token), err, ErrUnauthorized)
+		}
+	}
+}
+
+func TestLoadTokenFileErrors(t *testing.T) {
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"fields": "0000000000000001\n",
+		"eui":    "nope $2a$04$abcdefghijklmnopqrstuuqG5bGvGbKBFGC9T8Tz4NYRryq3bX9Hm\n",
+		"hash":   "0000000000000001 plaintext\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadTokenFile(path); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package basicstation
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultReplicas is the number of points per backend on the hash ring
+	DefaultReplicas = 64
+
+	// DefaultStickyTTL is how long a station keeps its backend without
+	// asking for it again
+	DefaultStickyTTL = 24 * time.Hour
+
+	// stickySweepInterval is how often expired assignments are dropped
+	stickySweepInterval = time.Minute
+)
+
+// ErrNoBackend is returned when no healthy muxs backend is available
+var ErrNoBackend = errors.New("no healthy muxs backend")
+
+// Backend is a muxs instance stations can be sent to
+type Backend struct {
+	// ID identifies the instance, it is the MUXS field of the response
+	ID string
+
+	// URI is the muxs URI template, {eui} is replaced by the station EUI
+	URI string
+}
+
+// Response returns the discovery response sending a station to the backend
+func (b Backend) Response(eui uint64) DiscoveryResponse {
+	return DiscoveryResponse{
+		URI:  strings.Replace(b.URI, "{eui}", RouterID{EUI: eui, Format: HexFormat}.String(), -1),
+		MUXS: b.ID,
+	}
+}
+
+// Balancer picks the muxs backend of a station. When DiscoveryHandler has a
+// Balancer the picked backend replaces the muxs of the server response.
+type Balancer interface {
+	Pick(eui uint64) (Backend, error)
+}
+
+// HashBalancer spreads stations over backends by consistent hashing of the
+// EUI. Unhealthy backends are taken off the ring, and a station keeps its
+// backend for as long as it is healthy so it reconnects to the same instance
+// when backends are added. Assignments of stations that stop asking expire
+// after StickyTTL.
+type HashBalancer struct {
+	// Replicas is the number of ring points per backend, DefaultReplicas if
+	// zero. It must be set before backends are added.
+	Replicas int
+
+	// StickyTTL is how long an assignment is kept after the station last
+	// asked for its backend, DefaultStickyTTL if zero
+	StickyTTL time.Duration
+
+	mu        sync.RWMutex
+	backends  map[string]*backendState
+	ring      []ringPoint
+	sticky    map[uint64]assignment
+	lastSweep time.Time
+}
+
+// assignment is the backend a station was sent to and when
+type assignment struct {
+	id   string
+	seen time.Time
+}
+
+type backendState struct {
+	Backend
+	healthy bool
+}
+
+type ringPoint struct {
+	hash uint64
+	id   string
+}
+
+// NewHashBalancer returns a balancer over healthy backends
+func NewHashBalancer(backends ...Backend) *HashBalancer {
+	hb := &HashBalancer{}
+	for _, b := range backends {
+		hb.Add(b)
+	}
+	return hb
+}
+
+// Add adds a healthy backend, replacing one with the same ID
+func (hb *HashBalancer) Add(b Backend) {
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+
+	if hb.backends == nil {
+		hb.backends = make(map[string]*backendState)
+	}
+	hb.backends[b.ID] = &backendState{Backend: b, healthy: true}
+	hb.rebuild()
+}
+
+// Remove removes a backend, its stations move to the other backends
+func (hb *HashBalancer) Remove(id string) {
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+
+	delete(hb.backends, id)
+	hb.forgetBackend(id)
+	hb.rebuild()
+}
+
+// SetHealthy takes a backend off the ring or puts it back
+func (hb *HashBalancer) SetHealthy(id string, healthy bool) {
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+
+	b, ok := hb.backends[id]
+	if !ok || b.healthy == healthy {
+		return
+	}
+	b.healthy = healthy
+	if !healthy {
+		hb.forgetBackend(id)
+	}
+	hb.rebuild()
+}
+
+// Backends returns the backends and whether they are healthy
+func (hb *HashBalancer) Backends() map[Backend]bool {
+	hb.mu.RLock()
+	defer hb.mu.RUnlock()
+
+	m := make(map[Backend]bool, len(hb.backends))
+	for _, b := range hb.backends {
+		m[b.Backend] = b.healthy
+	}
+	return m
+}
+
+// Forget drops the sticky assignment of a station
+func (hb *HashBalancer) Forget(eui uint64) {
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+
+	delete(hb.sticky, eui)
+}
+
+// Pick returns the backend of a station
+func (hb *HashBalancer) Pick(eui uint64) (Backend, error) {
+	now := time.Now()
+
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+
+	hb.sweep(now)
+
+	if a, ok := hb.sticky[eui]; ok {
+		if b, ok := hb.backends[a.id]; ok && b.healthy {
+			hb.sticky[eui] = assignment{id: a.id, seen: now}
+			return b.Backend, nil
+		}
+	}
+
+	if len(hb.ring) == 0 {
+		return Backend{}, ErrNoBackend
+	}
+
+	var key [8]byte
+	binary.BigEndian.PutUint64(key[:], eui)
+	h := hash64(key[:])
+
+	i := sort.Search(len(hb.ring), func(i int) bool { return hb.ring[i].hash >= h })
+	if i == len(hb.ring) {
+		i = 0
+	}
+	b := hb.backends[hb.ring[i].id]
+
+	if hb.sticky == nil {
+		hb.sticky = make(map[uint64]assignment)
+	}
+	hb.sticky[eui] = assignment{id: b.ID, seen: now}
+
+	return b.Backend, nil
+}
+
+// sweep drops the expired assignments, hb must be locked
+func (hb *HashBalancer) sweep(now time.Time) {
+	if now.Sub(hb.lastSweep) < stickySweepInterval {
+		return
+	}
+	hb.lastSweep = now
+
+	ttl := hb.StickyTTL
+	if ttl <= 0 {
+		ttl = DefaultStickyTTL
+	}
+
+	for eui, a := range hb.sticky {
+		if now.Sub(a.seen) > ttl {
+			delete(hb.sticky, eui)
+		}
+	}
+}
+
+// forgetBackend drops the assignments to a backend, hb must be locked
+func (hb *HashBalancer) forgetBackend(id string) {
+	for eui, a := range hb.sticky {
+		if a.id == id {
+			delete(hb.sticky, eui)
+		}
+	}
+}
+
+// Monitor probes every backend each interval until ctx is done, marking
+// backends whose probe fails unhealthy, which drops the assignments to them,
+// and those that recover healthy again
+func (hb *HashBalancer) Monitor(ctx context.Context, interval time.Duration, probe func(ctx context.Context, b Backend) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for b := range hb.Backends() {
+			hb.SetHealthy(b.ID, probe(ctx, b) == nil)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// rebuild recomputes the ring from the healthy backends, hb must be locked
+func (hb *HashBalancer) rebuild() {
+	replicas := hb.Replicas
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+
+	hb.ring = hb.ring[:0]
+	for id, b := range hb.backends {
+		if !b.healthy {
+			continue
+		}
+		for i := 0; i < replicas; i++ {
+			hb.ring = append(hb.ring, ringPoint{hash: hash64([]byte(id + "#" + strconv.Itoa(i))), id: id})
+		}
+	}
+
+	sort.Slice(hb.ring, func(i, j int) bool {
+		if hb.ring[i].hash == hb.ring[j].hash {
+			return hb.ring[i].id < hb.ring[j].id
+		}
+		return hb.ring[i].hash < hb.ring[j].hash
+	})
+}
+
+// hash64 is FNV-1a followed by the murmur3 finalizer, FNV alone clusters
+// keys differing in their last bytes such as consecutive EUIs
+func hash64(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	return x
+}
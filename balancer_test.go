@@ -0,0 +1,190 @@
+package basicstation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func testBackends(n int) []Backend {
+	backends := make([]Backend, n)
+	for i := range backends {
+		backends[i] = Backend{
+			ID:  fmt.Sprintf("::%d", i+1),
+			URI: fmt.Sprintf("wss://lns-%d.example.com/traffic/{eui}", i+1),
+		}
+	}
+	return backends
+}
+
+func TestHashBalancer(t *testing.T) {
+
+	backends := testBackends(3)
+	hb := NewHashBalancer(backends...)
+
+	const stations = 3000
+
+	// Stations spread over every backend
+	counts := make(map[string]int)
+	assigned := make(map[uint64]string)
+	for eui := uint64(1); eui <= stations; eui++ {
+		b, err := hb.Pick(eui)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[b.ID]++
+		assigned[eui] = b.ID
+	}
+	for _, b := range backends {
+		if counts[b.ID] < stations/10 {
+			t.Errorf("backend %s got %d of %d stations", b.ID, counts[b.ID], stations)
+		}
+	}
+
+	// A fresh balancer hashes stations the same way
+	other := NewHashBalancer(backends...)
+	for eui := uint64(1); eui <= 100; eui++ {
+		if b, _ := other.Pick(eui); b.ID != assigned[eui] {
+			t.Fatalf("station %d got %s, want %s", eui, b.ID, assigned[eui])
+		}
+	}
+
+	// Sticky assignments survive a new backend
+	hb.Add(Backend{ID: "::4", URI: "wss://lns-4.example.com/traffic/{eui}"})
+	for eui := uint64(1); eui <= stations; eui++ {
+		if b, _ := hb.Pick(eui); b.ID != assigned[eui] {
+			t.Fatalf("station %d moved from %s to %s", eui, assigned[eui], b.ID)
+		}
+	}
+
+	// Stations of an unhealthy backend move, the others stay
+	hb.SetHealthy("::1", false)
+	for eui := uint64(1); eui <= stations; eui++ {
+		b, _ := hb.Pick(eui)
+		switch {
+		case b.ID == "::1":
+			t.Fatalf("station %d on unhealthy backend", eui)
+		case assigned[eui] != "::1" && b.ID != assigned[eui]:
+			t.Fatalf("station %d moved from healthy %s to %s", eui, assigned[eui], b.ID)
+		}
+	}
+
+	for eui, a := range hb.sticky {
+		if a.id == "::1" {
+			t.Fatalf("station %d still assigned to unhealthy backend", eui)
+		}
+	}
+
+	for _, id := range []string{"::2", "::3", "::4"} {
+		hb.SetHealthy(id, false)
+	}
+	if _, err := hb.Pick(1); err != ErrNoBackend {
+		t.Errorf("pick with no healthy backend got %v, want %v", err, ErrNoBackend)
+	}
+}
+
+func TestHashBalancerStickyTTL(t *testing.T) {
+
+	hb := NewHashBalancer(testBackends(2)...)
+	hb.StickyTTL = time.Millisecond
+
+	for eui := uint64(1); eui <= 100; eui++ {
+		hb.Pick(eui)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	// Force the next pick to sweep
+	hb.lastSweep = time.Time{}
+	hb.Pick(1)
+
+	if len(hb.sticky) != 1 {
+		t.Errorf("%d assignments after expiry, want 1", len(hb.sticky))
+	}
+}
+
+func TestHashBalancerMonitor(t *testing.T) {
+
+	hb := NewHashBalancer(testBackends(2)...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		hb.Monitor(ctx, time.Millisecond, func(ctx context.Context, b Backend) error {
+			if b.ID == "::1" {
+				return errors.New("connection refused")
+			}
+			return nil
+		})
+		close(done)
+	}()
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if !hb.Backends()[testBackends(1)[0]] {
+			break
+		}
+	}
+	cancel()
+	<-done
+
+	for eui := uint64(1); eui <= 100; eui++ {
+		if b, _ := hb.Pick(eui); b.ID != "::2" {
+			t.Fatalf("station %d got backend %s, want ::2", eui, b.ID)
+		}
+	}
+}
+
+func TestDiscoveryBalancer(t *testing.T) {
+
+	hb := NewHashBalancer(testBackends(1)...)
+	h := DiscoveryHandler{Env: &Environment{Server: testServer{}}, Balancer: hb}
+
+	s, ws := newDiscoveryWSServer(t, h)
+	defer s.Close()
+	defer ws.Close()
+
+	sendMessage(t, ws, map[string]interface{}{"router": "::1"})
+
+	var reply DiscoveryResponse
+	receiveWSMessage(t, ws, &reply)
+	if reply.URI != "wss://lns-1.example.com/traffic/0000000000000001" || reply.MUXS != "::1" {
+		t.Errorf("discovery reply got %+v", reply)
+	}
+
+	hb.SetHealthy("::1", false)
+
+	s, ws = newDiscoveryWSServer(t, h)
+	defer s.Close()
+	defer ws.Close()
+
+	sendMessage(t, ws, map[string]interface{}{"router": "::1"})
+	reply = DiscoveryResponse{}
+	receiveWSMessage(t, ws, &reply)
+	if reply.Error != "no muxs available" {
+		t.Errorf("discovery reply got %+v", reply)
+	}
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Errorf("close got %v, want try again later", err)
+	}
+
+	// Unknown gateways are refused before a backend is picked
+	hb.SetHealthy("::1", true)
+	h.Env = &Environment{Server: discoveryErrorServer{err: ErrUnknownGateway}}
+
+	s, ws = newDiscoveryWSServer(t, h)
+	defer s.Close()
+	defer ws.Close()
+
+	sendMessage(t, ws, map[string]interface{}{"router": "::2"})
+	reply = DiscoveryResponse{}
+	receiveWSMessage(t, ws, &reply)
+	if reply.Error != "unknown gateway" || reply.URI != "" {
+		t.Errorf("discovery reply got %+v", reply)
+	}
+	if _, ok := hb.sticky[2]; ok {
+		t.Error("unknown gateway assigned a backend")
+	}
+}
@@ -11,7 +11,8 @@ import (
 	"github.com/rs/zerolog"
 )
 
-// Server is anything that implements a server interface
+// Server is anything that implements a server interface. GetDiscoveryResponse
+// returns ErrUnknownGateway for gateways it does not serve.
 type Server interface {
 	NewConnection(gw *Gateway)
 	GetDiscoveryResponse(eui uint64, r *http.Request) (DiscoveryResponse, error)
@@ -21,6 +22,15 @@ type Server interface {
 type Environment struct {
 	Server Server
 	Log    zerolog.Logger
+
+	// Registry, if set, tracks the sessions started by GatewayHandler
+	Registry *Registry
+
+	// Admission, if set, limits connection attempts to the gateway and
+	// discovery handlers
+	Admission *Admission
+
+	sessions sessionSet
 }
 
 // RxContext common uplink/downlink radio fields
@@ -59,6 +69,7 @@ type JoinRequest struct {
 	DR       int
 	Freq     int
 	UpInfo   UpInfo
+	RefTime  float64 `json:"RefTime,omitempty"`
 }
 
 // Uplink encodes an uplink frame
@@ -74,7 +85,18 @@ type Uplink struct {
 	DR         int
 	Freq       int
 	UpInfo     UpInfo
+	MsgType    string  `json:"msgtype"`
+	RefTime    float64 `json:"RefTime,omitempty"`
+}
+
+// ProprietaryFrame encodes a proprietary uplink frame (MHdr FType 111)
+type ProprietaryFrame struct {
 	MsgType    string `json:"msgtype"`
+	FRMPayload string
+	DR         int
+	Freq       int
+	UpInfo     UpInfo
+	RefTime    float64 `json:"RefTime,omitempty"`
 }
 
 // Downlink encodes a downlink frame
@@ -90,75 +112,21 @@ type Downlink struct {
 	RX2DR       *int  `json:",omitempty"`
 	RX2Freq     *int  `json:",omitempty"`
 	Priority    int   `json:"priority"`
-	Xtime       int64 `json:"xtime"`
+	Xtime       int64 `json:"xtime,omitempty"`
 	Rctx        int64 `json:"rctx"`
 }
 
 // DnTxed is the basic station transmit confirmation message
 type DnTxed struct {
-	DIID   int64     `json:"diid"`
-	DevEUI string    `json:"DevEui"`
-	TXTime float64   `json:"txtime"`
-	RCtx   RxContext `mapstructure:",squash"`
-}
-
-// RadioChannel defines an SX1301 channel configuration
-type RadioChannel struct {
-	Enable bool `json:"enable"`
-	Radio  uint `json:"radio"`
-	IF     int  `json:"if"`
-}
-
-// LoraStdChannel is a Radio channel with additional parameters
-type LoraStdChannel struct {
-	RadioChannel
-	Bandwidth       int `json:"bandwidth,omitempty"`
-	SpreadingFactor int `json:"spread_factor,omitempty"`
-}
-
-type FSKChannel struct {
-	RadioChannel
-	Bandwidth int `json:"bandwidth,omitempty"`
-	Datarate  int `json:"datarate,omitempty"`
-}
-
-// Radio is an SX1301 radio configuration
-type Radio struct {
-	Enable bool   `json:"enable"`
-	Freq   uint32 `json:"freq"`
-}
-
-// SX1301 defines how the channel plan maps to the individual SX1301 chips
-type SX1301 struct {
-	Radio0      Radio          `json:"radio_0"`
-	Radio1      Radio          `json:"radio_1"`
-	Channel0    RadioChannel   `json:"chan_multiSF_0"`
-	Channel1    RadioChannel   `json:"chan_multiSF_1"`
-	Channel2    RadioChannel   `json:"chan_multiSF_2"`
-	Channel3    RadioChannel   `json:"chan_multiSF_3"`
-	Channel4    RadioChannel   `json:"chan_multiSF_4"`
-	Channel5    RadioChannel   `json:"chan_multiSF_5"`
-	Channel6    RadioChannel   `json:"chan_multiSF_6"`
-	Channel7    RadioChannel   `json:"chan_multiSF_7"`
-	ChannelLora LoraStdChannel `json:"chan_Lora_std"`
-	ChannelFSK  FSKChannel     `json:"chan_FSK"`
-}
+	DIID    int64     `json:"diid"`
+	DevEUI  string    `json:"DevEui"`
+	TXTime  float64   `json:"txtime"`
+	RCtx    RxContext `mapstructure:",squash"`
+	RefTime float64   `json:"RefTime,omitempty"`
 
-// RouterConf message specifies a channelplan for the station and defines
-// some basic operation modes
-type RouterConf struct {
-	MessageType string   `json:"msgtype"`
-	DRs         [][]int  `json:",omitempty"`
-	NetID       [][]uint `json:",omitempty"`
-	JoinEUI     [][]uint `json:"JoinEui,omitempty"`
-	Region      string   `json:"region"`
-	HWSPEC      string   `json:"hwspec"`
-	FreqRange   []uint   `json:"freq_range,omitempty"`
-	SX1301s     []SX1301 `json:"sx1301_conf"`
-	NOCCA       bool     `json:"nocca,omitempty"`
-	NODC        bool     `json:"nodc,omitempty"`
-	NODWELL     bool     `json:"nodwell,omitempty"`
-	MaxEIRP     *int     `json:"max_eirp,omitempty"`
+	// Downlink is the Downlink or ScheduleEntry sent through the gateway
+	// with the same DIID, nil if not sent by this session
+	Downlink interface{} `json:"-" mapstructure:"-"`
 }
 
 // UnsupportedMsgType error
@@ -169,6 +137,15 @@ type UnsupportedMsgType struct {
 const (
 	// RouterConfMsgName is the router config message type field value
 	RouterConfMsgName = "router_config"
+
+	// DownlinkMsgName is the downlink message type field value
+	DownlinkMsgName = "dnmsg"
+
+	// DnSchedMsgName is the downlink schedule message type field value
+	DnSchedMsgName = "dnsched"
+
+	// proprietaryMHdr is the MHdr of a proprietary frame with major version 0
+	proprietaryMHdr = 0xe0
 )
 
 // Error satisifies error interface
@@ -204,8 +181,12 @@ func decode(r io.Reader) (interface{}, error) {
 			output = DnTxed{}
 		case "version":
 			output = Version{}
+		case TimeSyncMsgName:
+			output = TimeSync{}
+		case RemoteShellMsgName:
+			output = RemoteShellStatus{}
 		case "propdf":
-			// ignore
+			output = ProprietaryFrame{}
 		default:
 			err := UnsupportedMsgType{mtype: string(mt)}
 			return nil, err
@@ -221,6 +202,16 @@ func decode(r io.Reader) (interface{}, error) {
 	return output, nil
 }
 
+// NewProprietaryDownlink builds a downlink answering a proprietary frame.
+// The payload is prefixed with the proprietary MHdr and sent in the RX1 or
+// RX2 window of the router configuration region, as NewClassADownlink does
+// for an uplink.
+func NewProprietaryDownlink(frame ProprietaryFrame, conf RouterConf, payload []byte, rx1DROffset int) (Downlink, error) {
+	pdu := append([]byte{proprietaryMHdr}, payload...)
+
+	return NewClassADownlink(frame, conf, pdu, rx1DROffset)
+}
+
 // Encode json encodes the input and wraps it in a io.Reader
 func Encode(msg interface{}) (io.Reader, error) {
 	b, err := json.Marshal(&msg)
@@ -4,10 +4,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -55,6 +59,693 @@ func (s testServer) SetVersion(eui uint64, v Version) {
 func (s testServer) Write(m interface{}) {
 }
 
+// recordingServer hands out the gateway and the messages it receives
+type recordingServer struct {
+	testServer
+	gws  chan *Gateway
+	msgs chan interface{}
+	errs chan error
+
+	// configure is called before the gateway runs
+	configure func(gw *Gateway)
+}
+
+func newRecordingServer() *recordingServer {
+	return &recordingServer{
+		gws:  make(chan *Gateway, 1),
+		msgs: make(chan interface{}, 16),
+		errs: make(chan error, 8),
+	}
+}
+
+func (s *recordingServer) NewConnection(gw *Gateway) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if s.configure != nil {
+		s.configure(gw)
+	}
+	s.gws <- gw
+	s.errs <- gw.Run(ctx, s, s)
+}
+
+func (s *recordingServer) Receive(gw *Gateway, msg interface{}) {
+	s.msgs <- msg
+}
+
+// connectStation connects a station, completes the version/router_config
+// exchange and returns the server side gateway
+func connectStation(t *testing.T, rs *recordingServer, eui string, features string) (*httptest.Server, *websocket.Conn, *Gateway) {
+	t.Helper()
+
+	rs.conf = newRouterConf()
+	gh := GatewayHandler{Env: &Environment{Server: rs}}
+
+	s, ws := newStationWSServer(t, eui, gh)
+
+	sendMessage(t, ws, map[string]interface{}{
+		"msgtype":  "version",
+		"protocol": 2,
+		"features": features,
+	})
+
+	var conf RouterConf
+	receiveWSMessage(t, ws, &conf)
+
+	return s, ws, <-rs.gws
+}
+
+func TestDownlinkSchedule(t *testing.T) {
+
+	rs := newRecordingServer()
+	s, ws, gw := connectStation(t, rs, "0000000000000001", "gps")
+	defer s.Close()
+	defer ws.Close()
+
+	entry := NewScheduleEntry([]byte{0x01, 0x02}, 3, 868100000, 1300000000000000, 0)
+	if err := gw.SendSchedule(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	var sched DnSched
+	receiveWSMessage(t, ws, &sched)
+
+	if sched.MsgType != DnSchedMsgName || len(sched.Schedule) != 1 || !reflect.DeepEqual(sched.Schedule[0], entry) {
+		t.Fatalf("dnsched got %+v", sched)
+	}
+
+	sendMessage(t, ws, map[string]interface{}{
+		"msgtype": "dntxed",
+		"diid":    entry.DIID,
+		"rctx":    0,
+	})
+
+	select {
+	case msg := <-rs.msgs:
+		txed, ok := msg.(DnTxed)
+		if !ok {
+			t.Fatalf("received %T, want DnTxed", msg)
+		}
+		if !reflect.DeepEqual(txed.Downlink, entry) {
+			t.Errorf("dntxed downlink got=%+v, want=%+v", txed.Downlink, entry)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no dntxed received")
+	}
+
+	if err := gw.SendSchedule(ScheduleEntry{PDU: "00"}); err == nil {
+		t.Errorf("expected error for unanchored schedule entry")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+
+	rs := newRecordingServer()
+	s, ws, gw := connectStation(t, rs, "0000000000000001", "gps")
+	defer s.Close()
+	defer ws.Close()
+
+	entry := NewScheduleEntry([]byte{0x01}, 3, 868100000, 1300000000000000, 0)
+	if err := gw.SendSchedule(entry); err != nil {
+		t.Fatal(err)
+	}
+	var sched DnSched
+	receiveWSMessage(t, ws, &sched)
+
+	refTime := muxTime(time.Now().Add(-50 * time.Millisecond))
+	sendMessage(t, ws, map[string]interface{}{"msgtype": "dntxed", "diid": entry.DIID, "RefTime": refTime})
+	sendMessage(t, ws, map[string]interface{}{"msgtype": "bogus"})
+	ws.WriteMessage(websocket.TextMessage, []byte("{"))
+	<-rs.msgs
+
+	// The decode errors follow the dntxed on the same reader
+	var stats Stats
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if stats = gw.Snapshot(); stats.DecodeErrors == 2 {
+			break
+		}
+	}
+
+	if stats.WriteTextOk != 2 || stats.SentByType[RouterConfMsgName] != 1 || stats.SentByType[DnSchedMsgName] != 1 {
+		t.Errorf("sent stats got %+v", stats)
+	}
+	if stats.DownlinksSent != 1 || stats.DownlinksConfirmed != 1 {
+		t.Errorf("downlinks sent=%d confirmed=%d, want 1 and 1", stats.DownlinksSent, stats.DownlinksConfirmed)
+	}
+	if stats.RecvTextMsg != 3 || stats.RecvByType["dntxed"] != 1 || stats.RecvBytes == 0 {
+		t.Errorf("received stats got %+v", stats)
+	}
+	want := map[string]uint64{DecodeErrorUnsupportedMsgType: 1, DecodeErrorMalformedJSON: 1}
+	if !reflect.DeepEqual(stats.DecodeErrorsByKind, want) {
+		t.Errorf("decode errors got %v, want %v", stats.DecodeErrorsByKind, want)
+	}
+	if stats.Connected.IsZero() || stats.Uptime <= 0 {
+		t.Errorf("connected=%v uptime=%v", stats.Connected, stats.Uptime)
+	}
+	if stats.RoundTrip.Samples != 1 || stats.RoundTrip.Last < 50*time.Millisecond {
+		t.Errorf("round trip got %+v", stats.RoundTrip)
+	}
+	if got := gw.Stats(); got.DecodeErrors != stats.DecodeErrors || got.DownlinksSent != stats.DownlinksSent {
+		t.Errorf("Stats got %+v, want %+v", got, stats)
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+
+	rs := newRecordingServer()
+	s, ws, gw := connectStation(t, rs, "0000000000000001", "gps")
+	defer s.Close()
+	defer ws.Close()
+
+	const writers, perWriter = 8, 4
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < perWriter; j++ {
+				entry := NewScheduleEntry([]byte{byte(i), byte(j)}, 3, 868100000, 1300000000000000, 0)
+				if err := gw.SendSchedule(entry); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for i := 0; i < writers*perWriter; i++ {
+		var sched DnSched
+		receiveWSMessage(t, ws, &sched)
+		if sched.MsgType != DnSchedMsgName || len(sched.Schedule) != 1 {
+			t.Fatalf("dnsched got %+v", sched)
+		}
+		seen[sched.Schedule[0].PDU] = true
+	}
+	if len(seen) != writers*perWriter {
+		t.Errorf("received %d distinct schedules, want %d", len(seen), writers*perWriter)
+	}
+}
+
+func TestOutboundQueue(t *testing.T) {
+
+	q := newOutboundQueue(1)
+
+	if err := q.put(outboundMsg{data: []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.put(outboundMsg{data: []byte("b")}); err != ErrOutboundQueueFull {
+		t.Errorf("full queue put got %v, want %v", err, ErrOutboundQueueFull)
+	}
+
+	// Downlinks have their own capacity
+	if err := q.put(outboundMsg{data: []byte("c"), downlinks: 1}); err != nil {
+		t.Errorf("downlink put got %v", err)
+	}
+
+	close(q.closed)
+	if err := q.put(outboundMsg{data: []byte("d"), downlinks: 1}); err != ErrConnectionClosed {
+		t.Errorf("closed queue put got %v, want %v", err, ErrConnectionClosed)
+	}
+
+	sched := &DnSched{Schedule: make([]ScheduleEntry, 3)}
+	if downlinkCount(sched) != 3 || downlinkCount(Downlink{}) != 1 || downlinkCount(&TimeSync{}) != 0 {
+		t.Errorf("downlinkCount miscounted messages")
+	}
+	if !isUrgent(&TimeSync{TxTime: 1}) || isUrgent(&TimeSync{XTime: 1}) {
+		t.Errorf("isUrgent misclassified timesync messages")
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+
+	rs := newRecordingServer()
+	rs.configure = func(gw *Gateway) {
+		gw.PingInterval = 20 * time.Millisecond
+		gw.PongTimeout = 50 * time.Millisecond
+	}
+	s, ws, gw := connectStation(t, rs, "0000000000000001", "gps")
+	defer s.Close()
+	defer ws.Close()
+
+	// The station answers pings while it reads
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+
+	select {
+	case err := <-rs.errs:
+		t.Fatalf("session of a responsive station ended: %v", err)
+	default:
+	}
+
+	stats := gw.Snapshot()
+	if stats.PingsSent == 0 || stats.PongsReceived == 0 || stats.LastPong.IsZero() {
+		t.Errorf("keepalive stats got pings=%d pongs=%d last=%v", stats.PingsSent, stats.PongsReceived, stats.LastPong)
+	}
+}
+
+func TestKeepaliveTimeout(t *testing.T) {
+
+	rs := newRecordingServer()
+	rs.configure = func(gw *Gateway) {
+		gw.PingInterval = 20 * time.Millisecond
+		gw.PongTimeout = 50 * time.Millisecond
+	}
+	s, ws, gw := connectStation(t, rs, "0000000000000001", "gps")
+	defer s.Close()
+	defer ws.Close()
+
+	// The station does not read, so never answers a ping
+	select {
+	case err := <-rs.errs:
+		if err != ErrPeerTimeout {
+			t.Errorf("run got %v, want %v", err, ErrPeerTimeout)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("silent station not detected")
+	}
+
+	if stats := gw.Snapshot(); stats.PeerTimeouts != 1 {
+		t.Errorf("peer timeouts got %d, want 1", stats.PeerTimeouts)
+	}
+
+	// The close frame tells the station why, past the unanswered pings
+	ws.SetPingHandler(func(string) error { return nil })
+	for {
+		_, _, err := ws.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("station read got %v, want going away close", err)
+		}
+		break
+	}
+}
+
+func TestTimeSync(t *testing.T) {
+
+	rs := newRecordingServer()
+	s, ws, gw := connectStation(t, rs, "0000000000000001", "gps")
+	defer s.Close()
+	defer ws.Close()
+
+	before := GPSTime(time.Now())
+	sendMessage(t, ws, map[string]interface{}{
+		"msgtype": "timesync",
+		"txtime":  1234.5,
+	})
+
+	var reply TimeSync
+	receiveWSMessage(t, ws, &reply)
+
+	if reply.MsgType != TimeSyncMsgName || reply.TxTime != 1234.5 {
+		t.Fatalf("timesync reply got %+v", reply)
+	}
+	if reply.GPSTime < before || reply.GPSTime > GPSTime(time.Now()) {
+		t.Errorf("timesync gpstime=%d out of range", reply.GPSTime)
+	}
+
+	// Uplink with GPS time sets the xtime to GPS offset of the session
+	xtime := int64(0x0100000000001000)
+	sendMessage(t, ws, map[string]interface{}{
+		"msgtype": "updf",
+		"upinfo": map[string]interface{}{
+			"xtime":   xtime,
+			"gpstime": 1300000000000000,
+		},
+	})
+	<-rs.msgs
+
+	gps, ok := gw.XTimeToGPS(xtime + 500)
+	if !ok || gps != 1300000000000500 {
+		t.Errorf("xtime to gps got=%d,%v", gps, ok)
+	}
+
+	got, ok := gw.GPSToXTime(1300000000001000)
+	if !ok || got != xtime+1000 {
+		t.Errorf("gps to xtime got=%x,%v", got, ok)
+	}
+
+	if _, ok := gw.XTimeToGPS(0x0200000000001000); ok {
+		t.Errorf("xtime of another session converted")
+	}
+}
+
+func TestTimeSyncFromUplink(t *testing.T) {
+
+	rs := newRecordingServer()
+	s, ws, gw := connectStation(t, rs, "0000000000000001", "")
+	defer s.Close()
+	defer ws.Close()
+
+	if err := gw.sendTimeSyncFromUplink(); err == nil {
+		t.Fatal("timesync sent without an uplink")
+	}
+
+	xtime := int64(0x0100000000001000)
+	sendMessage(t, ws, map[string]interface{}{
+		"msgtype": "updf",
+		"upinfo":  map[string]interface{}{"xtime": xtime},
+	})
+	<-rs.msgs
+
+	if err := gw.sendTimeSyncFromUplink(); err != nil {
+		t.Fatal(err)
+	}
+
+	var transfer TimeSync
+	receiveWSMessage(t, ws, &transfer)
+	if transfer.XTime != xtime || transfer.GPSTime == 0 {
+		t.Errorf("timesync transfer got %+v", transfer)
+	}
+
+	// The estimate is not trusted as the offset of the session
+	if _, ok := gw.GPSOffset(); ok {
+		t.Error("offset set from an estimated transfer")
+	}
+
+	// The anchor is used once
+	if err := gw.sendTimeSyncFromUplink(); err == nil {
+		t.Error("timesync resent with a stale uplink")
+	}
+}
+
+func TestMuxTime(t *testing.T) {
+
+	rs := newRecordingServer()
+	s, ws, gw := connectStation(t, rs, "0000000000000001", "")
+	defer s.Close()
+	defer ws.Close()
+
+	if err := gw.SendTimeSync(100, 200); err != nil {
+		t.Fatal(err)
+	}
+
+	var msg map[string]interface{}
+	receiveWSMessage(t, ws, &msg)
+
+	mux, ok := msg["MuxTime"].(float64)
+	if !ok || msg["msgtype"] != TimeSyncMsgName {
+		t.Fatalf("message not stamped with MuxTime: %v", msg)
+	}
+
+	// Station echoes MuxTime plus its hold time as RefTime
+	sendMessage(t, ws, map[string]interface{}{
+		"msgtype": "updf",
+		"RefTime": mux - 0.25,
+	})
+	<-rs.msgs
+
+	rt := gw.RoundTrip()
+	if rt.Samples != 1 || rt.Last < 250*time.Millisecond || rt.Last > 5*time.Second || rt.Smoothed != rt.Last {
+		t.Errorf("round trip got %+v", rt)
+	}
+}
+
+func TestStampMuxTime(t *testing.T) {
+
+	now := time.Unix(1600000000, 500000000)
+
+	tcs := []struct {
+		in   string
+		want string
+	}{
+		{`{}`, `{"MuxTime":1600000000.500000}`},
+		{`{"msgtype":"dnmsg"}`, `{"MuxTime":1600000000.500000,"msgtype":"dnmsg"}`},
+		{`{"MuxTime":1.5}`, `{"MuxTime":1.5}`},
+		{`[]`, `[]`},
+	}
+
+	for _, tt := range tcs {
+		if got := string(stampMuxTime([]byte(tt.in), now)); got != tt.want {
+			t.Errorf("stamp %s got=%s, want=%s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+
+	rs := newRecordingServer()
+	s, ws, gw := connectStation(t, rs, "0000000000000001", "gps rmtsh")
+	defer s.Close()
+	defer ws.Close()
+
+	if err := gw.RunCommand(context.Background(), "/bin/restart", []string{"-f"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var cmd RunCmd
+	receiveWSMessage(t, ws, &cmd)
+
+	want := RunCmd{MsgType: RunCmdMsgName, Command: "/bin/restart", Arguments: []string{"-f"}}
+	if !reflect.DeepEqual(cmd, want) {
+		t.Errorf("runcmd got=%+v, want=%+v", cmd, want)
+	}
+
+	gw.Capabilities = ParseCapabilities("gps")
+	err := gw.RunCommand(context.Background(), "/bin/restart", nil)
+	if _, ok := err.(UnsupportedFeature); !ok {
+		t.Errorf("runcmd without rmtsh feature got err=%v", err)
+	}
+}
+
+func TestRemoteShell(t *testing.T) {
+
+	rs := newRecordingServer()
+	s, ws, gw := connectStation(t, rs, "0000000000000001", "rmtsh")
+	defer s.Close()
+	defer ws.Close()
+
+	sh, err := gw.StartRemoteShell("root", "xterm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ctrl RemoteShellCtrl
+	receiveWSMessage(t, ws, &ctrl)
+	if ctrl.MsgType != RemoteShellMsgName || ctrl.User != "root" || ctrl.Start == nil || *ctrl.Start != sh.Session() {
+		t.Fatalf("rmtsh start got %+v", ctrl)
+	}
+
+	// Shell input is sent as binary frame prefixed with the session
+	if _, err := sh.Write([]byte("ls\n")); err != nil {
+		t.Fatal(err)
+	}
+	mt, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mt != websocket.BinaryMessage || !bytes.Equal(data, []byte{byte(sh.Session()), 'l', 's', '\n'}) {
+		t.Fatalf("rmtsh data got type=%d %q", mt, data)
+	}
+
+	// Shell output is demultiplexed to the session
+	if err := ws.WriteMessage(websocket.BinaryMessage, []byte{byte(sh.Session()), 'o', 'k'}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, err := sh.Read(buf)
+	if err != nil || string(buf[:n]) != "ok" {
+		t.Fatalf("rmtsh read got %q, err=%v", buf[:n], err)
+	}
+
+	if err := sh.Close(); err != nil {
+		t.Fatal(err)
+	}
+	receiveWSMessage(t, ws, &ctrl)
+	if ctrl.Stop == nil || *ctrl.Stop != sh.Session() {
+		t.Fatalf("rmtsh stop got %+v", ctrl)
+	}
+	if _, err := sh.Read(buf); err != io.EOF {
+		t.Errorf("read after close got err=%v", err)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+
+	caps := ParseCapabilities("rmtsh  gps updn-dr lbt")
+
+	if !caps.Has(CapRemoteShell) || !caps.Has(CapGPS|CapUpDnDR) {
+		t.Errorf("capabilities missing in %s", caps)
+	}
+	if caps.Has(CapProd) || caps.Has(CapGPS|CapCUPS) {
+		t.Errorf("unexpected capabilities in %s", caps)
+	}
+	if !reflect.DeepEqual(caps.Unknown(), []string{"lbt"}) {
+		t.Errorf("unknown features got %v", caps.Unknown())
+	}
+	if caps.String() != "rmtsh gps updn-dr lbt" {
+		t.Errorf("capabilities string got %q", caps.String())
+	}
+}
+
+func TestUnsupportedProtocol(t *testing.T) {
+
+	ts := testServer{conf: newRouterConf()}
+	gh := GatewayHandler{Env: &Environment{Server: ts}}
+
+	s, ws := newStationWSServer(t, "0000000000000001", gh)
+	defer s.Close()
+	defer ws.Close()
+
+	sendMessage(t, ws, map[string]interface{}{
+		"msgtype":  "version",
+		"protocol": 1,
+	})
+
+	_, _, err := ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("expected policy violation close, got %v", err)
+	}
+}
+
+func TestRouterConfRoundTrip(t *testing.T) {
+
+	in := `{
+		"msgtype": "router_config",
+		"region": "EU863",
+		"hwspec": "sx1302/1",
+		"freq_range": [863000000, 870000000],
+		"upchannels": [[868100000, 0, 5], [868300000, 0, 6]],
+		"bcning": {"DR": 3, "layout": [2, 8, 17], "freqs": [869525000]},
+		"nocca": true,
+		"vendor_option": {"x": 1},
+		"sx1302_conf": [{
+			"lorawan_public": false,
+			"radio_0": {"enable": true, "freq": 867500000, "type": "SX1250", "rssi_offset": -215.4, "tx_enable": true},
+			"radio_1": {"enable": true, "freq": 868500000, "type": "SX1250", "tx_enable": false},
+			"chan_multiSF_0": {"enable": true, "radio": 1, "if": -400},
+			"chan_multiSF_All": {"spreading_factor_enable": [5, 6, 7, 8, 9, 10, 11, 12]},
+			"chan_Lora_std": {"enable": true, "radio": 1, "if": -200, "bandwidth": 250000, "spread_factor": 7},
+			"chan_FSK": {"enable": true, "radio": 1, "if": 300, "bandwidth": 125000, "datarate": 50000},
+			"sx1261_conf": {"rssi_offset": 0, "lbt": {"enable": true, "rssi_target": -70, "channels": [{"freq_hz": 868100000, "bandwidth": 125000, "scan_time_us": 128, "transmit_time_ms": 4000}]}},
+			"board_type": "MASTER"
+		}]
+	}`
+
+	var conf RouterConf
+	if err := json.Unmarshal([]byte(in), &conf); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(conf.SX1302s) != 1 || conf.SX1302s[0].Radio0.Type != "SX1250" || *conf.SX1302s[0].LoRaWANPublic {
+		t.Fatalf("sx1302_conf got %+v", conf.SX1302s)
+	}
+	if conf.Beaconing == nil || conf.Beaconing.Layout != [3]int{2, 8, 17} || len(conf.UpChannels) != 2 {
+		t.Fatalf("bcning/upchannels got %+v %v", conf.Beaconing, conf.UpChannels)
+	}
+	if _, ok := conf.Extra["vendor_option"]; !ok {
+		t.Errorf("unknown router_config field not kept: %v", conf.Extra)
+	}
+	if _, ok := conf.SX1302s[0].Extra["board_type"]; !ok {
+		t.Errorf("unknown sx1302_conf field not kept: %v", conf.SX1302s[0].Extra)
+	}
+
+	out, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got RouterConf
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, conf) {
+		t.Errorf("router_config round trip\ngot:  %+v\nwant: %+v", got, conf)
+	}
+	if !bytes.Contains(out, []byte(`"vendor_option":{"x":1}`)) || !bytes.Contains(out, []byte(`"board_type":"MASTER"`)) {
+		t.Errorf("unknown fields not encoded: %s", out)
+	}
+}
+
+func TestRouterConfNestedRoundTrip(t *testing.T) {
+
+	in := `{
+		"msgtype": "router_config",
+		"region": "EU863",
+		"hwspec": "sx1302/1",
+		"bcning": {"DR": 3, "layout": [2, 8, 17], "freqs": [869525000], "vendor": "x"},
+		"sx1302_conf": [{
+			"radio_0": {"enable": true, "freq": 867500000, "type": "SX1250",
+				"rssi_tcomp": {"coeff_a": 0, "coeff_b": 0, "coeff_c": 20.41, "coeff_d": 2162.56, "coeff_e": 0}},
+			"chan_multiSF_0": {"enable": true, "radio": 0, "if": -400000, "note": "main"},
+			"chan_Lora_std": {"enable": true, "radio": 0, "if": -200000, "bandwidth": 250000, "spread_factor": 7, "cr": "4/5"},
+			"chan_multiSF_All": {"spreading_factor_enable": [7, 8], "boost": true},
+			"sx1261_conf": {"rssi_offset": 0, "spectral_scan": {"enable": false}, "lbt": {"enable": true, "rssi_target": -70,
+				"channels": [{"freq_hz": 868100000, "scan_time_us": 128, "hint": 1}]}}
+		}]
+	}`
+
+	var conf RouterConf
+	if err := json.Unmarshal([]byte(in), &conf); err != nil {
+		t.Fatal(err)
+	}
+
+	board := conf.SX1302s[0]
+	if _, ok := board.Radio0.Extra["rssi_tcomp"]; !ok {
+		t.Errorf("radio_0.rssi_tcomp not kept: %v", board.Radio0.Extra)
+	}
+	if string(board.ChannelLora.Extra["cr"]) != `"4/5"` {
+		t.Errorf("chan_Lora_std.cr not kept: %v", board.ChannelLora.Extra)
+	}
+
+	out, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same json, absent radio_1, chan_FSK and chan_multiSF_1 to 7 included
+	var want, got interface{}
+	if err := json.Unmarshal([]byte(in), &want); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("router_config round trip\ngot:  %s\nwant: %s", out, in)
+	}
+
+	// A section set after decoding is sent
+	conf.SX1302s[0].Radio1 = Radio{Enable: true, Freq: 868500000}
+	out, err = json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out, []byte(`"radio_1":{"enable":true,"freq":868500000}`)) {
+		t.Errorf("radio_1 set after decoding not encoded: %s", out)
+	}
+}
+
+func TestInvalidRouterConf(t *testing.T) {
+
+	ts := testServer{conf: RouterConf{MessageType: RouterConfMsgName, Region: "RU864", DRs: [][]int{{7, 125, 0}}}}
+	gh := GatewayHandler{Env: &Environment{Server: ts}}
+
+	s, ws := newStationWSServer(t, "0000000000000001", gh)
+	defer s.Close()
+	defer ws.Close()
+
+	sendMessage(t, ws, map[string]interface{}{
+		"msgtype":  "version",
+		"protocol": 2,
+	})
+
+	_, _, err := ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseInternalServerErr) {
+		t.Errorf("expected internal error close, got %v", err)
+	}
+}
+
 func TestDiscoveryHandler(t *testing.T) {
 
 	tcs := []struct {
@@ -66,8 +757,27 @@ func TestDiscoveryHandler(t *testing.T) {
 			name:    "with good request containing router as number",
 			message: map[string]interface{}{"router": 1},
 			reply: DiscoveryResponse{
-				URI:  "ws://discovery-test.com:8080/0000000000000001",
-				MUXS: "TBD",
+				Router: "1",
+				URI:    "ws://discovery-test.com:8080/0000000000000001",
+				MUXS:   "TBD",
+			},
+		},
+		{
+			name:    "with good request containing router as ID6",
+			message: map[string]interface{}{"router": "::1"},
+			reply: DiscoveryResponse{
+				Router: "::1",
+				URI:    "ws://discovery-test.com:8080/0000000000000001",
+				MUXS:   "TBD",
+			},
+		},
+		{
+			name:    "with good request containing router as EUI",
+			message: map[string]interface{}{"router": "00-00-00-00-00-00-00-01"},
+			reply: DiscoveryResponse{
+				Router: "00-00-00-00-00-00-00-01",
+				URI:    "ws://discovery-test.com:8080/0000000000000001",
+				MUXS:   "TBD",
 			},
 		},
 	}
@@ -76,8 +786,10 @@ func TestDiscoveryHandler(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 
 			// Initialize test response
+			// The handler fills in the router id, the server leaves it out
 			ts := testServer{}
 			ts.discovery = tt.reply
+			ts.discovery.Router = ""
 
 			// test environment
 			env := &Environment{Server: ts}
@@ -102,6 +814,114 @@ func TestDiscoveryHandler(t *testing.T) {
 	}
 }
 
+func TestDiscoveryResponseEcho(t *testing.T) {
+
+	for _, tt := range []struct {
+		id   interface{}
+		want string
+	}{
+		{json.Number("1"), `{"router":1,"uri":"ws://muxs"}`},
+		{"::1", `{"router":"::1","uri":"ws://muxs"}`},
+	} {
+		var response DiscoveryResponse
+		response.Router = "ignored"
+		response.URI = "ws://muxs"
+		response.echo(mustRouterID(tt.id))
+
+		b, err := json.Marshal(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("%v: got %s, want %s", tt.id, b, tt.want)
+		}
+	}
+}
+
+// discoveryErrorServer fails discovery requests with err
+type discoveryErrorServer struct {
+	testServer
+	err error
+}
+
+func (s discoveryErrorServer) GetDiscoveryResponse(eui uint64, r *http.Request) (DiscoveryResponse, error) {
+	return DiscoveryResponse{URI: "ws://leaked"}, s.err
+}
+
+func TestDiscoveryErrors(t *testing.T) {
+
+	tcs := []struct {
+		name    string
+		err     error
+		message interface{}
+		reply   DiscoveryResponse
+		code    int
+	}{
+		{
+			name:    "unknown gateway",
+			err:     fmt.Errorf("lookup: %w", ErrUnknownGateway),
+			message: map[string]interface{}{"router": "::1"},
+			reply:   DiscoveryResponse{Router: "::1", Error: "unknown gateway"},
+			code:    websocket.ClosePolicyViolation,
+		},
+		{
+			name:    "server error",
+			err:     errors.New("database down"),
+			message: map[string]interface{}{"router": 1},
+			reply:   DiscoveryResponse{Router: "1", Error: "server error"},
+			code:    websocket.CloseInternalServerErr,
+		},
+		{
+			name:    "malformed router id",
+			message: map[string]interface{}{"router": "1:2:3"},
+			reply:   DiscoveryResponse{Error: "malformed router id"},
+			code:    websocket.CloseUnsupportedData,
+		},
+		{
+			name:    "missing router",
+			message: map[string]interface{}{},
+			reply:   DiscoveryResponse{Error: "missing router field"},
+			code:    websocket.CloseUnsupportedData,
+		},
+		{
+			name:    "unexpected field",
+			message: map[string]interface{}{"eui": 1},
+			reply:   DiscoveryResponse{Error: `malformed request: unexpected field "eui"`},
+			code:    websocket.CloseUnsupportedData,
+		},
+		{
+			name:    "not json",
+			message: "router",
+			reply:   DiscoveryResponse{Error: "malformed request: Value contains an invalid value for the \"\" field (at position 8)"},
+			code:    websocket.CloseUnsupportedData,
+		},
+	}
+
+	for _, tt := range tcs {
+		t.Run(tt.name, func(t *testing.T) {
+
+			env := &Environment{Server: discoveryErrorServer{err: tt.err}}
+			s, ws := newDiscoveryWSServer(t, DiscoveryHandler{Env: env})
+			defer s.Close()
+			defer ws.Close()
+
+			sendMessage(t, ws, tt.message)
+
+			var reply DiscoveryResponse
+			receiveWSMessage(t, ws, &reply)
+
+			if !reflect.DeepEqual(reply, tt.reply) {
+				t.Errorf("Expected '%+v', got '%+v'", tt.reply, reply)
+			}
+
+			_, _, err := ws.ReadMessage()
+			if !websocket.IsCloseError(err, tt.code) {
+				t.Errorf("close got %v, want code %d", err, tt.code)
+			}
+		})
+	}
+}
+
 func TestStationRouterConf(t *testing.T) {
 
 	defVer := map[string]interface{}{
@@ -147,6 +967,12 @@ func TestStationRouterConf(t *testing.T) {
 			var gotConf RouterConf
 			receiveWSMessage(t, ws, &gotConf)
 
+			// MuxTime is stamped on every message sent to the station
+			if gotConf.MuxTime == 0 {
+				t.Errorf("router_config not stamped with MuxTime")
+			}
+			gotConf.MuxTime = 0
+
 			if !reflect.DeepEqual(gotConf, tt.wantConf) {
 				t.Fatalf("Expected '%+v', got '%+v'", tt.wantConf, gotConf)
 			}
@@ -182,6 +1008,142 @@ func TestUplink(t *testing.T) {
 
 }
 
+func TestProprietaryFrame(t *testing.T) {
+
+	m := map[string]interface{}{
+		"msgtype":    "propdf",
+		"FRMPayload": "0102ab",
+		"DR":         5,
+		"Freq":       868100000,
+		"upinfo": map[string]interface{}{
+			"rctx":  2,
+			"xtime": 12345,
+			"rssi":  -50,
+			"snr":   9.5,
+		},
+	}
+
+	b := bytes.Buffer{}
+	json.NewEncoder(&b).Encode(&m)
+
+	value, err := decode(&b)
+	if err != nil {
+		t.Fatalf("decode propdf failed: %v", err)
+	}
+
+	frame, ok := value.(ProprietaryFrame)
+	if !ok {
+		t.Fatalf("decode propdf got %T", value)
+	}
+
+	if frame.FRMPayload != "0102ab" || frame.DR != 5 || frame.Freq != 868100000 {
+		t.Errorf("propdf got %+v", frame)
+	}
+	if frame.UpInfo.RCtx.XTime != 12345 || frame.UpInfo.SNR != 9.5 {
+		t.Errorf("propdf upinfo got %+v", frame.UpInfo)
+	}
+
+	dl, err := NewProprietaryDownlink(frame, RouterConf{Region: "EU863"}, []byte{0x01}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dl.PDU != "e001" || *dl.RX1Freq != frame.Freq || *dl.RX1DR != frame.DR || dl.Xtime != 12345 || dl.Rctx != 2 {
+		t.Errorf("proprietary downlink got %+v", dl)
+	}
+	if *dl.RX2DR != 0 || *dl.RX2Freq != 869525000 {
+		t.Errorf("proprietary downlink RX2 got DR%d/%d", *dl.RX2DR, *dl.RX2Freq)
+	}
+
+	// US915 answers on the downlink channel and DR of the uplink channel
+	frame.DR, frame.Freq = 0, 902300000
+	dl, err = NewProprietaryDownlink(frame, RouterConf{Region: "US915"}, []byte{0x01}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *dl.RX1DR != 10 || *dl.RX1Freq != 923300000 || *dl.RX2DR != 8 || *dl.RX2Freq != 923300000 {
+		t.Errorf("US915 proprietary downlink got RX1 DR%d/%d RX2 DR%d/%d", *dl.RX1DR, *dl.RX1Freq, *dl.RX2DR, *dl.RX2Freq)
+	}
+}
+
+func TestClassADownlink(t *testing.T) {
+
+	upinfo := UpInfo{RCtx: RxContext{RCTX: 3, XTime: 777}}
+
+	tcs := []struct {
+		name        string
+		region      string
+		msg         interface{}
+		offset      int
+		wantDelay   int
+		wantRX1DR   int
+		wantRX1Freq int
+		wantRX2DR   int
+		wantRX2Freq int
+	}{
+		{
+			name:        "EU868 uplink",
+			region:      "EU863",
+			msg:         Uplink{DR: 5, Freq: 868300000, UpInfo: upinfo},
+			offset:      2,
+			wantDelay:   1,
+			wantRX1DR:   3,
+			wantRX1Freq: 868300000,
+			wantRX2DR:   0,
+			wantRX2Freq: 869525000,
+		},
+		{
+			name:        "US915 join request",
+			region:      "US902",
+			msg:         JoinRequest{DevEUI: "00-00-00-00-00-00-00-01", DR: 0, Freq: 904100000, UpInfo: upinfo},
+			wantDelay:   5,
+			wantRX1DR:   10,
+			wantRX1Freq: 923900000,
+			wantRX2DR:   8,
+			wantRX2Freq: 923300000,
+		},
+		{
+			name:        "AS923 uplink with raising offset",
+			region:      "AS923-1",
+			msg:         &Uplink{DR: 3, Freq: 923200000, UpInfo: upinfo},
+			offset:      7,
+			wantDelay:   1,
+			wantRX1DR:   5,
+			wantRX1Freq: 923200000,
+			wantRX2DR:   2,
+			wantRX2Freq: 923200000,
+		},
+	}
+
+	for _, tt := range tcs {
+		t.Run(tt.name, func(t *testing.T) {
+			dl, err := NewClassADownlink(tt.msg, RouterConf{Region: tt.region}, []byte{0x20}, tt.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if dl.MsgType != DownlinkMsgName || dl.PDU != "20" || dl.DIID == 0 {
+				t.Errorf("downlink got %+v", dl)
+			}
+			if dl.RxDelay != tt.wantDelay {
+				t.Errorf("RxDelay got=%d, want=%d", dl.RxDelay, tt.wantDelay)
+			}
+			if *dl.RX1DR != tt.wantRX1DR || *dl.RX1Freq != tt.wantRX1Freq {
+				t.Errorf("RX1 got=DR%d/%d, want=DR%d/%d", *dl.RX1DR, *dl.RX1Freq, tt.wantRX1DR, tt.wantRX1Freq)
+			}
+			if *dl.RX2DR != tt.wantRX2DR || *dl.RX2Freq != tt.wantRX2Freq {
+				t.Errorf("RX2 got=DR%d/%d, want=DR%d/%d", *dl.RX2DR, *dl.RX2Freq, tt.wantRX2DR, tt.wantRX2Freq)
+			}
+			if dl.Xtime != 777 || dl.Rctx != 3 {
+				t.Errorf("xtime/rctx got=%d/%d", dl.Xtime, dl.Rctx)
+			}
+		})
+	}
+
+	if _, err := NewClassADownlink(Uplink{}, RouterConf{Region: "XX000"}, nil, 0); err == nil {
+		t.Errorf("expected unknown region error")
+	}
+}
+
 func newDiscoveryWSServer(t *testing.T, h http.Handler) (*httptest.Server, *websocket.Conn) {
 	t.Helper()
 
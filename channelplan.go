@@ -0,0 +1,210 @@
+package basicstation
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	// radiosPerBoard is the number of radios feeding an SX1301/SX1302
+	radiosPerBoard = 2
+	// multiSFChannels is the number of multi-SF channels of a board
+	multiSFChannels = 8
+)
+
+// planChannel is a channel of a board plan
+type planChannel struct {
+	freq     int
+	bw       int
+	sf       int
+	datarate int
+}
+
+// boardPlan is the set of channels served by a single SX1301/SX1302
+type boardPlan struct {
+	multiSF []int
+	std     *planChannel
+	fsk     *planChannel
+}
+
+// radioBandwidth returns the radio receive bandwidth in Hz usable by
+// channels of a bandwidth
+func radioBandwidth(bw int) int {
+	switch {
+	case bw <= 125000:
+		return 925000
+	case bw <= 250000:
+		return 1000000
+	default:
+		return 1100000
+	}
+}
+
+// maxIF returns the largest IF offset in Hz of a channel of a bandwidth,
+// keeping the channel inside the radio bandwidth
+func maxIF(bw int) int {
+	return radioBandwidth(bw)/2 - bw/2
+}
+
+// GenerateRouterConf generates a router configuration with the default
+// channel plan of a region for a number of SX1301 boards. subBand is the
+// 1-based sub-band of the first board for US915, AU915 and CN470, each
+// further board serves the next sub-band; zero selects the first. Regions
+// with a single fixed plan support one board only.
+func GenerateRouterConf(regionName string, boards int, subBand int) (RouterConf, error) {
+	reg, err := lookupRegion(regionName)
+	if err != nil {
+		return RouterConf{}, err
+	}
+
+	if subBand == 0 {
+		subBand = 1
+	}
+
+	maxBoards := 1
+	if reg.subBands > 0 {
+		if subBand < 1 || subBand > reg.subBands {
+			return RouterConf{}, fmt.Errorf("%s has no sub-band %d", reg.name, subBand)
+		}
+		maxBoards = reg.subBands - subBand + 1
+	}
+	if boards < 1 || boards > maxBoards {
+		return RouterConf{}, fmt.Errorf("%s supports 1 to %d boards from sub-band %d, not %d",
+			reg.name, maxBoards, subBand, boards)
+	}
+
+	maxEIRP := reg.maxEIRP
+	conf := RouterConf{
+		MessageType: RouterConfMsgName,
+		Region:      reg.name,
+		HWSPEC:      fmt.Sprintf("sx1301/%d", boards),
+		DRs:         copyDRs(reg.drs),
+		FreqRange:   append([]uint(nil), reg.freqRange...),
+		MaxEIRP:     &maxEIRP,
+	}
+
+	for b := 0; b < boards; b++ {
+		board, err := layoutBoard(reg.plan(subBand + b))
+		if err != nil {
+			return RouterConf{}, fmt.Errorf("%s board %d: %v", reg.name, b, err)
+		}
+		conf.SX1301s = append(conf.SX1301s, board)
+	}
+
+	return conf, nil
+}
+
+func copyDRs(drs [][]int) [][]int {
+	out := make([][]int, len(drs))
+	for i, dr := range drs {
+		out[i] = append([]int(nil), dr...)
+	}
+	return out
+}
+
+// radioGroup is a set of channels sharing a radio, lo and hi bound the
+// radio centre frequencies that keep every channel within its IF limit
+type radioGroup struct {
+	lo, hi   int
+	channels []*planChannel
+}
+
+func (g *radioGroup) fits(ch *planChannel) (lo, hi int, ok bool) {
+	lo, hi = ch.freq-maxIF(ch.bw), ch.freq+maxIF(ch.bw)
+	if len(g.channels) > 0 {
+		if g.lo > lo {
+			lo = g.lo
+		}
+		if g.hi < hi {
+			hi = g.hi
+		}
+	}
+	return lo, hi, lo <= hi
+}
+
+func (g *radioGroup) centre() int {
+	return (g.lo + g.hi) / 2
+}
+
+// layoutBoard assigns the channels of a plan to the two radios of a board,
+// centring each radio within the frequencies its channels allow and
+// computing the channel IF offsets
+func layoutBoard(plan boardPlan) (SX1301, error) {
+	var board SX1301
+
+	if len(plan.multiSF) > multiSFChannels {
+		return board, fmt.Errorf("%d multi-SF channels, at most %d", len(plan.multiSF), multiSFChannels)
+	}
+
+	channels := make([]*planChannel, 0, len(plan.multiSF)+2)
+	for _, f := range plan.multiSF {
+		channels = append(channels, &planChannel{freq: f, bw: 125000})
+	}
+	if plan.std != nil {
+		channels = append(channels, plan.std)
+	}
+	if plan.fsk != nil {
+		channels = append(channels, plan.fsk)
+	}
+
+	sorted := append([]*planChannel(nil), channels...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].freq < sorted[j].freq })
+
+	// Greedily fill the radios from the lowest frequency up
+	var groups []*radioGroup
+	radioOf := map[*planChannel]int{}
+	for _, ch := range sorted {
+		if len(groups) > 0 {
+			g := groups[len(groups)-1]
+			if lo, hi, ok := g.fits(ch); ok {
+				g.lo, g.hi = lo, hi
+				g.channels = append(g.channels, ch)
+				radioOf[ch] = len(groups) - 1
+				continue
+			}
+		}
+		if len(groups) == radiosPerBoard {
+			return board, fmt.Errorf("channels span more than %d radios", radiosPerBoard)
+		}
+		g := &radioGroup{}
+		g.lo, g.hi, _ = g.fits(ch)
+		g.channels = append(g.channels, ch)
+		groups = append(groups, g)
+		radioOf[ch] = len(groups) - 1
+	}
+
+	radios := []*Radio{&board.Radio0, &board.Radio1}
+	for i, g := range groups {
+		*radios[i] = Radio{Enable: true, Freq: uint32(g.centre())}
+	}
+
+	channel := func(ch *planChannel) RadioChannel {
+		r := radioOf[ch]
+		return RadioChannel{Enable: true, Radio: uint(r), IF: ch.freq - groups[r].centre()}
+	}
+
+	multiSF := []*RadioChannel{
+		&board.Channel0, &board.Channel1, &board.Channel2, &board.Channel3,
+		&board.Channel4, &board.Channel5, &board.Channel6, &board.Channel7,
+	}
+	for i := range plan.multiSF {
+		*multiSF[i] = channel(channels[i])
+	}
+
+	if plan.std != nil {
+		board.ChannelLora = LoraStdChannel{
+			RadioChannel:    channel(plan.std),
+			Bandwidth:       plan.std.bw,
+			SpreadingFactor: plan.std.sf,
+		}
+	}
+	if plan.fsk != nil {
+		board.ChannelFSK = FSKChannel{
+			RadioChannel: channel(plan.fsk),
+			Bandwidth:    plan.fsk.bw,
+			Datarate:     plan.fsk.datarate,
+		}
+	}
+
+	return board, nil
+}
@@ -0,0 +1,215 @@
+package basicstation
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestGenerateRouterConf(t *testing.T) {
+
+	tcs := []struct {
+		region   string
+		boards   int
+		subBand  int
+		channels int
+	}{
+		{"EU868", 1, 0, 10},
+		{"US915", 1, 2, 9},
+		{"US915", 2, 1, 18},
+		{"AU915", 1, 1, 9},
+		{"AS923-1", 1, 0, 10},
+		{"AS923-2", 1, 0, 10},
+		{"AS923-3", 1, 0, 10},
+		{"AS923-4", 1, 0, 10},
+		{"KR920", 1, 0, 8},
+		{"IN865", 1, 0, 7},
+		{"CN470", 3, 4, 24},
+	}
+
+	for _, tt := range tcs {
+		t.Run(tt.region, func(t *testing.T) {
+			conf, err := GenerateRouterConf(tt.region, tt.boards, tt.subBand)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(conf.SX1301s) != tt.boards || len(conf.DRs) != 16 || conf.MaxEIRP == nil {
+				t.Fatalf("router_config got %+v", conf)
+			}
+
+			channels := 0
+			for _, board := range conf.SX1301s {
+				radios := []Radio{board.Radio0, board.Radio1}
+				check := func(ch RadioChannel, bw int) {
+					if !ch.Enable {
+						return
+					}
+					channels++
+					if !radios[ch.Radio].Enable {
+						t.Errorf("channel %+v on disabled radio", ch)
+					}
+					if ch.IF > maxIF(bw) || ch.IF < -maxIF(bw) {
+						t.Errorf("channel %+v IF out of range", ch)
+					}
+					freq := uint(int(radios[ch.Radio].Freq) + ch.IF)
+					if freq < conf.FreqRange[0] || freq > conf.FreqRange[1] {
+						t.Errorf("channel %d Hz outside %v", freq, conf.FreqRange)
+					}
+				}
+				for _, ch := range []RadioChannel{
+					board.Channel0, board.Channel1, board.Channel2, board.Channel3,
+					board.Channel4, board.Channel5, board.Channel6, board.Channel7,
+				} {
+					check(ch, 125000)
+				}
+				check(board.ChannelLora.RadioChannel, board.ChannelLora.Bandwidth)
+				check(board.ChannelFSK.RadioChannel, board.ChannelFSK.Bandwidth)
+			}
+
+			if channels != tt.channels {
+				t.Errorf("enabled channels got=%d, want=%d", channels, tt.channels)
+			}
+
+			if err := conf.Validate(); err != nil {
+				t.Errorf("generated router_config invalid: %v", err)
+			}
+		})
+	}
+}
+
+func TestGenerateRouterConfLayout(t *testing.T) {
+
+	conf, err := GenerateRouterConf("US915", 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	board := conf.SX1301s[0]
+	if board.Radio0.Freq != 904300000 || board.Radio1.Freq != 905100000 {
+		t.Errorf("radios got %d/%d", board.Radio0.Freq, board.Radio1.Freq)
+	}
+	if !reflect.DeepEqual(board.Channel0, RadioChannel{Enable: true, Radio: 0, IF: -400000}) ||
+		!reflect.DeepEqual(board.Channel7, RadioChannel{Enable: true, Radio: 1, IF: 200000}) {
+		t.Errorf("channels got %+v %+v", board.Channel0, board.Channel7)
+	}
+	if board.ChannelLora.IF != 300000 || board.ChannelLora.Bandwidth != 500000 || board.ChannelLora.SpreadingFactor != 8 {
+		t.Errorf("lora std channel got %+v", board.ChannelLora)
+	}
+
+	b, _ := json.Marshal(conf.DRs[4])
+	if string(b) != "[8,500,0]" {
+		t.Errorf("DR4 got %s", b)
+	}
+
+	for _, tt := range []struct {
+		region  string
+		boards  int
+		subBand int
+	}{
+		{"EU868", 2, 0},
+		{"US915", 2, 8},
+		{"US915", 1, 9},
+		{"XX000", 1, 0},
+	} {
+		if _, err := GenerateRouterConf(tt.region, tt.boards, tt.subBand); err == nil {
+			t.Errorf("%s boards=%d sub-band=%d expected error", tt.region, tt.boards, tt.subBand)
+		}
+	}
+}
+
+func TestValidateRouterConf(t *testing.T) {
+
+	eirp := 20
+
+	tcs := []struct {
+		name   string
+		modify func(conf *RouterConf)
+		fields []string
+	}{
+		{
+			name:   "valid",
+			modify: func(conf *RouterConf) {},
+		},
+		{
+			name:   "IF outside radio window",
+			modify: func(conf *RouterConf) { conf.SX1301s[0].Channel3.IF = 500000 },
+			fields: []string{"sx1301_conf[0].chan_multiSF_3.if"},
+		},
+		{
+			name: "channel on disabled radio",
+			modify: func(conf *RouterConf) {
+				conf.SX1301s[0].Radio1.Enable = false
+			},
+			fields: []string{
+				"sx1301_conf[0].chan_multiSF_0.radio",
+				"sx1301_conf[0].chan_multiSF_1.radio",
+				"sx1301_conf[0].chan_multiSF_2.radio",
+				"sx1301_conf[0].chan_Lora_std.radio",
+				"sx1301_conf[0].chan_FSK.radio",
+			},
+		},
+		{
+			name:   "radio outside frequency range",
+			modify: func(conf *RouterConf) { conf.FreqRange = []uint{863000000, 868000000} },
+			fields: []string{
+				"sx1301_conf[0].radio_1.freq",
+				"sx1301_conf[0].chan_multiSF_0.if",
+				"sx1301_conf[0].chan_multiSF_1.if",
+				"sx1301_conf[0].chan_multiSF_2.if",
+				"sx1301_conf[0].chan_Lora_std.if",
+				"sx1301_conf[0].chan_FSK.if",
+			},
+		},
+		{
+			name:   "DR table shape",
+			modify: func(conf *RouterConf) { conf.DRs[3] = []int{13, 125}; conf.DRs = conf.DRs[:8] },
+			fields: []string{"DRs", "DRs[3]"},
+		},
+		{
+			name:   "EIRP above region limit",
+			modify: func(conf *RouterConf) { conf.MaxEIRP = &eirp },
+			fields: []string{"max_eirp"},
+		},
+		{
+			name: "unknown region skips regional checks",
+			modify: func(conf *RouterConf) {
+				conf.Region = "RU864"
+				conf.MaxEIRP = &eirp
+				conf.SX1301s[0].Channel3.IF = 500000
+			},
+			fields: []string{"sx1301_conf[0].chan_multiSF_3.if"},
+		},
+	}
+
+	for _, tt := range tcs {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := GenerateRouterConf("EU863", 1, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.modify(&conf)
+
+			err = conf.Validate()
+			if len(tt.fields) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			errs, ok := err.(ValidationErrors)
+			if !ok {
+				t.Fatalf("expected ValidationErrors, got %v", err)
+			}
+
+			var fields []string
+			for _, e := range errs {
+				fields = append(fields, e.Field)
+			}
+			if !reflect.DeepEqual(fields, tt.fields) {
+				t.Errorf("invalid fields got=%v, want=%v", fields, tt.fields)
+			}
+		})
+	}
+}
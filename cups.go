@@ -0,0 +1,236 @@
+package basicstation
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+const (
+	// CUPSURL is the CUPS update info URL path
+	CUPSURL = "/update-info"
+
+	// maxCUPSRequest bounds the size of an update info request body
+	maxCUPSRequest = 64 * 1024
+)
+
+// CUPSRequest is the update info request a station posts to CUPS. The CRCs
+// identify the credentials the station has, Keys the CRCs of the signing
+// keys it can verify updates with.
+type CUPSRequest struct {
+	Router      RouterID `json:"router"`
+	CUPSURI     string   `json:"cupsUri"`
+	TCURI       string   `json:"tcUri"`
+	CUPSCredCRC uint32   `json:"cupsCredCrc"`
+	TCCredCRC   uint32   `json:"tcCredCrc"`
+	Station     string   `json:"station"`
+	Model       string   `json:"model"`
+	Package     string   `json:"package"`
+	Keys        []uint32 `json:"keys"`
+}
+
+// CUPSResponse is the update info answer. Empty fields leave the station
+// configuration unchanged. A signed update carries the CRC of the key it
+// was signed with.
+type CUPSResponse struct {
+	CUPSURI   string
+	TCURI     string
+	CUPSCred  []byte
+	TCCred    []byte
+	KeyCRC    uint32
+	Signature []byte
+	Update    []byte
+}
+
+// MarshalBinary encodes the response in the CUPS binary layout: URIs with a
+// one byte length, credentials with a two byte length, then the signature
+// with its key CRC and the update with four byte lengths, all little endian
+func (c CUPSResponse) MarshalBinary() ([]byte, error) {
+	switch {
+	case len(c.CUPSURI) > 0xff:
+		return nil, fmt.Errorf("cupsUri too long: %d bytes", len(c.CUPSURI))
+	case len(c.TCURI) > 0xff:
+		return nil, fmt.Errorf("tcUri too long: %d bytes", len(c.TCURI))
+	case len(c.CUPSCred) > 0xffff:
+		return nil, fmt.Errorf("cups credentials too long: %d bytes", len(c.CUPSCred))
+	case len(c.TCCred) > 0xffff:
+		return nil, fmt.Errorf("tc credentials too long: %d bytes", len(c.TCCred))
+	}
+
+	size := 1 + len(c.CUPSURI) + 1 + len(c.TCURI) + 2 + len(c.CUPSCred) + 2 + len(c.TCCred) + 4 + 4 + len(c.Signature) + 4 + len(c.Update)
+	b := make([]byte, 0, size)
+
+	b = append(b, byte(len(c.CUPSURI)))
+	b = append(b, c.CUPSURI...)
+	b = append(b, byte(len(c.TCURI)))
+	b = append(b, c.TCURI...)
+
+	b = appendUint16(b, uint16(len(c.CUPSCred)))
+	b = append(b, c.CUPSCred...)
+	b = appendUint16(b, uint16(len(c.TCCred)))
+	b = append(b, c.TCCred...)
+
+	if len(c.Signature) > 0 {
+		b = appendUint32(b, uint32(4+len(c.Signature)))
+		b = appendUint32(b, c.KeyCRC)
+		b = append(b, c.Signature...)
+	} else {
+		b = appendUint32(b, 0)
+	}
+
+	b = appendUint32(b, uint32(len(c.Update)))
+	b = append(b, c.Update...)
+
+	return b, nil
+}
+
+// UnmarshalBinary decodes a response in the CUPS binary layout
+func (c *CUPSResponse) UnmarshalBinary(b []byte) error {
+	next := func(n int) ([]byte, error) {
+		if len(b) < n {
+			return nil, io.ErrUnexpectedEOF
+		}
+		v := b[:n]
+		b = b[n:]
+		return v, nil
+	}
+	length := func(size int) (int, error) {
+		v, err := next(size)
+		if err != nil {
+			return 0, err
+		}
+		switch size {
+		case 1:
+			return int(v[0]), nil
+		case 2:
+			return int(binary.LittleEndian.Uint16(v)), nil
+		}
+		return int(binary.LittleEndian.Uint32(v)), nil
+	}
+	field := func(size int) ([]byte, error) {
+		n, err := length(size)
+		if err != nil {
+			return nil, err
+		}
+		return next(n)
+	}
+
+	var resp CUPSResponse
+
+	uri, err := field(1)
+	if err != nil {
+		return err
+	}
+	resp.CUPSURI = string(uri)
+
+	if uri, err = field(1); err != nil {
+		return err
+	}
+	resp.TCURI = string(uri)
+
+	if resp.CUPSCred, err = field(2); err != nil {
+		return err
+	}
+	if resp.TCCred, err = field(2); err != nil {
+		return err
+	}
+
+	sig, err := field(4)
+	if err != nil {
+		return err
+	}
+	if len(sig) > 0 {
+		if len(sig) < 4 {
+			return errors.New("cups signature without key crc")
+		}
+		resp.KeyCRC = binary.LittleEndian.Uint32(sig)
+		resp.Signature = sig[4:]
+	}
+
+	if resp.Update, err = field(4); err != nil {
+		return err
+	}
+	if len(b) != 0 {
+		return fmt.Errorf("%d trailing bytes after cups response", len(b))
+	}
+
+	*c = resp
+
+	return nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+// CUPSBackend decides what a station gets from CUPS. It returns
+// ErrUnknownGateway for stations it does not serve.
+type CUPSBackend interface {
+	UpdateInfo(req CUPSRequest, r *http.Request) (CUPSResponse, error)
+}
+
+// CUPSHandler is the Basic Station CUPS HTTP handler
+type CUPSHandler struct {
+	Env     *Environment
+	Backend CUPSBackend
+}
+
+func (handler CUPSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handler.Env.sessions.isClosing() {
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req CUPSRequest
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxCUPSRequest))
+	if err := dec.Decode(&req); err != nil {
+		handler.Env.Log.Warn().Err(err).Msg("cups decode request")
+		http.Error(w, "malformed update info request", http.StatusBadRequest)
+		return
+	}
+
+	// Only a router id parsed from the body has its raw notation, an absent
+	// field would otherwise read as EUI 0
+	if req.Router.raw == "" {
+		handler.Env.Log.Warn().Msg("cups request no router")
+		http.Error(w, "missing router", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := handler.Backend.UpdateInfo(req, r)
+	switch {
+	case errors.Is(err, ErrUnknownGateway):
+		handler.Env.Log.Info().Str("router", req.Router.String()).Msg("cups request from unknown gateway")
+		http.Error(w, "unknown gateway", http.StatusNotFound)
+		return
+	case err != nil:
+		handler.Env.Log.Error().Err(err).Str("router", req.Router.String()).Msg("cups update info")
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	b, err := resp.MarshalBinary()
+	if err != nil {
+		handler.Env.Log.Error().Err(err).Str("router", req.Router.String()).Msg("cups encode response")
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := w.Write(b); err != nil {
+		handler.Env.Log.Debug().Err(err).Msg("cups write response")
+	}
+}
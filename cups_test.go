@@ -0,0 +1,146 @@
+package basicstation
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCUPSResponseBinary(t *testing.T) {
+
+	resp := CUPSResponse{
+		CUPSURI:   "https://c",
+		TCURI:     "wss://t",
+		CUPSCred:  []byte{1, 2},
+		TCCred:    []byte{3},
+		KeyCRC:    0x11223344,
+		Signature: []byte{0xaa, 0xbb},
+		Update:    []byte{0xcc},
+	}
+
+	b, err := resp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want []byte
+	want = append(want, 9)
+	want = append(want, "https://c"...)
+	want = append(want, 7)
+	want = append(want, "wss://t"...)
+	want = append(want, 2, 0, 1, 2)
+	want = append(want, 1, 0, 3)
+	want = append(want, 6, 0, 0, 0, 0x44, 0x33, 0x22, 0x11, 0xaa, 0xbb)
+	want = append(want, 1, 0, 0, 0, 0xcc)
+
+	if !bytes.Equal(b, want) {
+		t.Fatalf("binary got % x, want % x", b, want)
+	}
+
+	var decoded CUPSResponse
+	if err := decoded.UnmarshalBinary(b); err != nil || !reflect.DeepEqual(decoded, resp) {
+		t.Errorf("decode got %+v, %v", decoded, err)
+	}
+
+	// Nothing to update
+	b, _ = CUPSResponse{}.MarshalBinary()
+	if !bytes.Equal(b, make([]byte, 14)) {
+		t.Errorf("empty response got % x", b)
+	}
+
+	if _, err := (CUPSResponse{TCURI: strings.Repeat("x", 256)}).MarshalBinary(); err == nil {
+		t.Errorf("expected error for a long uri")
+	}
+	if err := decoded.UnmarshalBinary(want[:len(want)-1]); err == nil {
+		t.Errorf("expected error for a truncated response")
+	}
+}
+
+// cupsTestBackend records the request and answers with resp or err
+type cupsTestBackend struct {
+	req  CUPSRequest
+	resp CUPSResponse
+	err  error
+}
+
+func (b *cupsTestBackend) UpdateInfo(req CUPSRequest, r *http.Request) (CUPSResponse, error) {
+	b.req = req
+	return b.resp, b.err
+}
+
+func TestCUPSHandler(t *testing.T) {
+
+	backend := &cupsTestBackend{resp: CUPSResponse{TCURI: "wss://lns.example.com:8887"}}
+	s := httptest.NewServer(CUPSHandler{Env: &Environment{}, Backend: backend})
+	defer s.Close()
+
+	body := `{"router":"::1","cupsUri":"https://cups.example.com","tcUri":"wss://old.example.com",
+		"cupsCredCrc":1,"tcCredCrc":2,"station":"2.0.5","model":"linux","package":"1.0.0","keys":[3,4]}`
+
+	res, err := http.Post(s.URL+CUPSURL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	want := CUPSRequest{
+		Router:      *mustRouterID("::1"),
+		CUPSURI:     "https://cups.example.com",
+		TCURI:       "wss://old.example.com",
+		CUPSCredCRC: 1,
+		TCCredCRC:   2,
+		Station:     "2.0.5",
+		Model:       "linux",
+		Package:     "1.0.0",
+		Keys:        []uint32{3, 4},
+	}
+	if !reflect.DeepEqual(backend.req, want) {
+		t.Errorf("request got %+v, want %+v", backend.req, want)
+	}
+
+	var resp CUPSResponse
+	if err := resp.UnmarshalBinary(b); err != nil || resp.TCURI != "wss://lns.example.com:8887" {
+		t.Errorf("response got %+v, %v", resp, err)
+	}
+
+	tcs := []struct {
+		name   string
+		method string
+		body   string
+		err    error
+		status int
+	}{
+		{"get", http.MethodGet, "", nil, http.StatusMethodNotAllowed},
+		{"malformed", http.MethodPost, "{", nil, http.StatusBadRequest},
+		{"missing router", http.MethodPost, `{"station":"2.0.5","package":"1.0.0"}`, nil, http.StatusBadRequest},
+		{"unknown gateway", http.MethodPost, body, ErrUnknownGateway, http.StatusNotFound},
+		{"server error", http.MethodPost, body, errors.New("boom"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tcs {
+		t.Run(tt.name, func(t *testing.T) {
+			backend.err = tt.err
+			backend.req = CUPSRequest{}
+
+			req, _ := http.NewRequest(tt.method, s.URL+CUPSURL, strings.NewReader(tt.body))
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != tt.status {
+				t.Errorf("status got %d, want %d", res.StatusCode, tt.status)
+			}
+			if tt.status == http.StatusBadRequest && !reflect.DeepEqual(backend.req, CUPSRequest{}) {
+				t.Errorf("backend called with %+v", backend.req)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package basicstation
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ClassA is the dnmsg device class field value for class A devices
+	ClassA = 0
+	// ClassB is the dnmsg device class field value for class B devices
+	ClassB = 1
+	// ClassC is the dnmsg device class field value for class C devices
+	ClassC = 2
+
+	// rxDelay is the default class A RX1 delay in seconds
+	rxDelay = 1
+	// joinAcceptDelay is the class A RX1 delay in seconds of a join accept
+	joinAcceptDelay = 5
+
+	// pendingTxTimeout is how long a sent downlink waits for its dntxed
+	pendingTxTimeout = 10 * time.Minute
+)
+
+// DnSched encodes a downlink schedule of absolute time transmissions
+type DnSched struct {
+	MsgType  string          `json:"msgtype"`
+	Schedule []ScheduleEntry `json:"schedule"`
+}
+
+// ScheduleEntry is a single dnsched transmission, anchored either at GPS
+// time or at the xtime of the radio context
+type ScheduleEntry struct {
+	DIID     int64  `json:"diid"`
+	PDU      string `json:"pdu"`
+	DR       int    `json:"DR"`
+	Freq     int    `json:"Freq"`
+	Priority int    `json:"priority"`
+	GPSTime  int64  `json:"gpstime,omitempty"`
+	XTime    int64  `json:"xtime,omitempty"`
+	Rctx     int64  `json:"rctx"`
+}
+
+// lastDIID is the last downlink identifier handed out by nextDIID
+var lastDIID int64
+
+// nextDIID returns a process wide unique downlink identifier
+func nextDIID() int64 {
+	return atomic.AddInt64(&lastDIID, 1)
+}
+
+// NewClassADownlink builds a class A dnmsg answering a decoded Uplink,
+// JoinRequest or ProprietaryFrame. RX1 and RX2 parameters are derived from the region of the
+// router configuration, rx1DROffset is the RX1 DR offset of the device.
+// DevEui is taken from a join request, set it on the result for uplinks.
+func NewClassADownlink(msg interface{}, conf RouterConf, pdu []byte, rx1DROffset int) (Downlink, error) {
+	var dr, freq int
+	var info UpInfo
+
+	dl := Downlink{
+		MsgType:     DownlinkMsgName,
+		DeviceClass: ClassA,
+		DIID:        nextDIID(),
+		PDU:         hex.EncodeToString(pdu),
+		RxDelay:     rxDelay,
+	}
+
+	switch msg := msg.(type) {
+	case Uplink:
+		dr, freq, info = msg.DR, msg.Freq, msg.UpInfo
+	case *Uplink:
+		dr, freq, info = msg.DR, msg.Freq, msg.UpInfo
+	case JoinRequest:
+		dr, freq, info = msg.DR, msg.Freq, msg.UpInfo
+		dl.DevEui = msg.DevEUI
+		dl.RxDelay = joinAcceptDelay
+	case *JoinRequest:
+		dr, freq, info = msg.DR, msg.Freq, msg.UpInfo
+		dl.DevEui = msg.DevEUI
+		dl.RxDelay = joinAcceptDelay
+	case ProprietaryFrame:
+		dr, freq, info = msg.DR, msg.Freq, msg.UpInfo
+	case *ProprietaryFrame:
+		dr, freq, info = msg.DR, msg.Freq, msg.UpInfo
+	default:
+		return Downlink{}, fmt.Errorf("cannot answer message of type %T", msg)
+	}
+
+	reg, err := lookupRegion(conf.Region)
+	if err != nil {
+		return Downlink{}, err
+	}
+
+	rx1DR, err := reg.rx1DR(dr, rx1DROffset)
+	if err != nil {
+		return Downlink{}, err
+	}
+
+	rx1Freq, err := reg.rx1Freq(freq)
+	if err != nil {
+		return Downlink{}, err
+	}
+
+	rx2DR, rx2Freq := reg.rx2DR, reg.rx2Freq
+
+	dl.RX1DR = &rx1DR
+	dl.RX1Freq = &rx1Freq
+	dl.RX2DR = &rx2DR
+	dl.RX2Freq = &rx2Freq
+	dl.Xtime = info.RCtx.XTime
+	dl.Rctx = info.RCtx.RCTX
+
+	return dl, nil
+}
+
+// NewClassCDownlink builds a class C dnmsg sent immediately in the RX2 window
+// of the router configuration region. rctx selects the antenna, use the one
+// of the last uplink received from the device.
+func NewClassCDownlink(devEUI string, conf RouterConf, pdu []byte, rctx int64) (Downlink, error) {
+	reg, err := lookupRegion(conf.Region)
+	if err != nil {
+		return Downlink{}, err
+	}
+
+	rx2DR, rx2Freq := reg.rx2DR, reg.rx2Freq
+
+	return Downlink{
+		MsgType:     DownlinkMsgName,
+		DeviceClass: ClassC,
+		DevEui:      devEUI,
+		DIID:        nextDIID(),
+		PDU:         hex.EncodeToString(pdu),
+		RX2DR:       &rx2DR,
+		RX2Freq:     &rx2Freq,
+		Rctx:        rctx,
+	}, nil
+}
+
+// NewScheduleEntry builds a dnsched entry transmitted at a GPS time given in
+// microseconds
+func NewScheduleEntry(pdu []byte, dr, freq int, gpstime int64, rctx int64) ScheduleEntry {
+	return ScheduleEntry{
+		DIID:    nextDIID(),
+		PDU:     hex.EncodeToString(pdu),
+		DR:      dr,
+		Freq:    freq,
+		GPSTime: gpstime,
+		Rctx:    rctx,
+	}
+}
+
+// pendingTx is a downlink waiting for its transmit confirmation
+type pendingTx struct {
+	msg    interface{}
+	sentAt time.Time
+}
+
+// pendingTxs correlates sent downlinks with dntxed confirmations by DIID
+type pendingTxs struct {
+	sync.Mutex
+	txs map[int64]pendingTx
+}
+
+func (p *pendingTxs) add(diid int64, msg interface{}) {
+	now := time.Now()
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.txs == nil {
+		p.txs = make(map[int64]pendingTx)
+	}
+
+	// Forget downlinks the station never confirmed
+	for id, tx := range p.txs {
+		if now.Sub(tx.sentAt) > pendingTxTimeout {
+			delete(p.txs, id)
+		}
+	}
+
+	p.txs[diid] = pendingTx{msg: msg, sentAt: now}
+}
+
+func (p *pendingTxs) remove(diid int64) interface{} {
+	p.Lock()
+	defer p.Unlock()
+
+	tx, ok := p.txs[diid]
+	if !ok {
+		return nil
+	}
+	delete(p.txs, diid)
+
+	return tx.msg
+}
+
+// confirm attaches the sent downlink to a transmit confirmation
+func (p *pendingTxs) confirm(txed DnTxed) DnTxed {
+	txed.Downlink = p.remove(txed.DIID)
+	return txed
+}
+
+// SendDownlink sends a dnmsg to the gateway. A DIID is assigned if missing
+// and the downlink is handed back in the DnTxed confirming it.
+func (gw *Gateway) SendDownlink(dl Downlink) error {
+	if dl.MsgType == "" {
+		dl.MsgType = DownlinkMsgName
+	}
+	if dl.DIID == 0 {
+		dl.DIID = nextDIID()
+	}
+
+	gw.pending.add(dl.DIID, dl)
+
+	err := gw.WriteJSON(&dl)
+	if err != nil {
+		gw.pending.remove(dl.DIID)
+	}
+
+	return err
+}
+
+// SendSchedule sends a dnsched with the given entries to the gateway. DIIDs
+// are assigned if missing and each entry is handed back in the DnTxed
+// confirming it. Stations without GPS get GPS time entries converted to
+// xtime when the session GPS offset is known, they are refused otherwise.
+func (gw *Gateway) SendSchedule(entries ...ScheduleEntry) error {
+	if len(entries) == 0 {
+		return errors.New("empty downlink schedule")
+	}
+
+	msg := DnSched{
+		MsgType:  DnSchedMsgName,
+		Schedule: make([]ScheduleEntry, len(entries)),
+	}
+
+	for i, e := range entries {
+		if e.GPSTime == 0 && e.XTime == 0 {
+			return fmt.Errorf("schedule entry %d has neither gpstime nor xtime", i)
+		}
+		if e.XTime == 0 && !gw.Capabilities.Has(CapGPS) {
+			xtime, ok := gw.GPSToXTime(e.GPSTime)
+			if !ok {
+				return UnsupportedFeature{feature: CapGPS}
+			}
+			e.XTime, e.GPSTime = xtime, 0
+		}
+		if e.DIID == 0 {
+			e.DIID = nextDIID()
+		}
+		msg.Schedule[i] = e
+	}
+
+	for _, e := range msg.Schedule {
+		gw.pending.add(e.DIID, e)
+	}
+
+	err := gw.WriteJSON(&msg)
+	if err != nil {
+		for _, e := range msg.Schedule {
+			gw.pending.remove(e.DIID)
+		}
+	}
+
+	return err
+}
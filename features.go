@@ -0,0 +1,134 @@
+package basicstation
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// MinProtocolVersion is the oldest station protocol version supported
+	MinProtocolVersion = 2
+	// MaxProtocolVersion is the newest station protocol version supported
+	MaxProtocolVersion = 2
+)
+
+// Capability is a station feature advertised in Version.Features
+type Capability uint
+
+const (
+	// CapRemoteShell station supports remote shells and remote commands
+	CapRemoteShell Capability = 1 << iota
+	// CapGPS station has a GPS and knows GPS time
+	CapGPS
+	// CapProd station is a production build
+	CapProd
+	// CapCUPS station updates itself through a CUPS server
+	CapCUPS
+	// CapUpDnDR station supports separate uplink and downlink DR tables
+	CapUpDnDR
+)
+
+// capabilityNames maps capabilities to their Version.Features names
+var capabilityNames = []struct {
+	c    Capability
+	name string
+}{
+	{CapRemoteShell, "rmtsh"},
+	{CapGPS, "gps"},
+	{CapProd, "prod"},
+	{CapCUPS, "cups"},
+	{CapUpDnDR, "updn-dr"},
+}
+
+// String returns the feature name of the capability
+func (c Capability) String() string {
+	for _, cn := range capabilityNames {
+		if cn.c == c {
+			return cn.name
+		}
+	}
+	return fmt.Sprintf("capability(%#x)", uint(c))
+}
+
+// Capabilities is the parsed set of features a station advertised
+type Capabilities struct {
+	set     Capability
+	unknown []string
+}
+
+// ParseCapabilities parses a space separated Version.Features string
+func ParseCapabilities(features string) Capabilities {
+	var caps Capabilities
+
+next:
+	for _, f := range strings.Fields(features) {
+		for _, cn := range capabilityNames {
+			if cn.name == f {
+				caps.set |= cn.c
+				continue next
+			}
+		}
+		caps.unknown = append(caps.unknown, f)
+	}
+
+	return caps
+}
+
+// Has reports whether every given capability is in the set
+func (caps Capabilities) Has(c Capability) bool {
+	return caps.set&c == c
+}
+
+// Unknown returns the advertised features this package does not know
+func (caps Capabilities) Unknown() []string {
+	return caps.unknown
+}
+
+// String returns the capabilities in Version.Features form
+func (caps Capabilities) String() string {
+	var names []string
+	for _, cn := range capabilityNames {
+		if caps.Has(cn.c) {
+			names = append(names, cn.name)
+		}
+	}
+	return strings.Join(append(names, caps.unknown...), " ")
+}
+
+// UnsupportedFeature error
+type UnsupportedFeature struct {
+	feature Capability
+}
+
+// Error satisifies error interface
+func (u UnsupportedFeature) Error() string {
+	return fmt.Sprintf("station does not support feature: %s", u.feature)
+}
+
+// requires returns an UnsupportedFeature error unless the station advertised
+// the capability
+func (gw *Gateway) requires(c Capability) error {
+	if !gw.Capabilities.Has(c) {
+		return UnsupportedFeature{feature: c}
+	}
+	return nil
+}
+
+// UnsupportedProtocol error
+type UnsupportedProtocol struct {
+	version uint
+}
+
+// Error satisifies error interface
+func (u UnsupportedProtocol) Error() string {
+	return fmt.Sprintf("unsupported station protocol version %d, want %d to %d",
+		u.version, MinProtocolVersion, MaxProtocolVersion)
+}
+
+// checkProtocol checks the station protocol version is supported
+func checkProtocol(v Version) error {
+	if v.Protocol < MinProtocolVersion || v.Protocol > MaxProtocolVersion {
+		return UnsupportedProtocol{version: v.Protocol}
+	}
+	return nil
+}
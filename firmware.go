@@ -0,0 +1,306 @@
+package basicstation
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SigningKey is an ECDSA P-256 key signing firmware updates. Stations verify
+// updates with the public key, identified by the CRC of its raw form.
+type SigningKey struct {
+	priv *ecdsa.PrivateKey
+	crc  uint32
+}
+
+// NewSigningKey wraps a P-256 private key
+func NewSigningKey(priv *ecdsa.PrivateKey) (*SigningKey, error) {
+	if priv.Curve != elliptic.P256() {
+		return nil, errors.New("signing key is not a P-256 key")
+	}
+
+	k := &SigningKey{priv: priv}
+	k.crc = crc32.ChecksumIEEE(k.StationKey())
+
+	return k, nil
+}
+
+// LoadSigningKey reads a PEM encoded EC or PKCS #8 P-256 private key file
+func LoadSigningKey(path string) (*SigningKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+
+	var priv interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		priv, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		priv, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %s", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	ec, ok := priv.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ECDSA key", path)
+	}
+
+	return NewSigningKey(ec)
+}
+
+// StationKey returns the public key as installed on stations, the 32 byte
+// big endian X and Y coordinates
+func (k *SigningKey) StationKey() []byte {
+	b := make([]byte, 64)
+	k.priv.X.FillBytes(b[:32])
+	k.priv.Y.FillBytes(b[32:])
+	return b
+}
+
+// CRC returns the CRC32 of the station key, the id stations list in the
+// keys field of their update info request
+func (k *SigningKey) CRC() uint32 {
+	return k.crc
+}
+
+// Sign returns the ASN.1 DER ECDSA signature of the SHA-512 digest of data
+func (k *SigningKey) Sign(data []byte) ([]byte, error) {
+	digest := sha512.Sum512(data)
+	return ecdsa.SignASN1(rand.Reader, k.priv, digest[:])
+}
+
+// Firmware is an update blob and the stations it is meant for
+type Firmware struct {
+	// Model the update is built for, Version.Model. Empty matches any.
+	Model string
+
+	// Package is the package version the update installs, only stations
+	// reporting an older Version.Package get it
+	Package string
+
+	// From, if set, restricts the update to stations on this package, such
+	// as a delta update or a deliberate downgrade
+	From string
+
+	// Firmware restricts the update to stations running this firmware,
+	// Version.Firmware. Empty matches any.
+	Firmware string
+
+	// Rollout is the percentage of matching stations, 0 to 100, that get the
+	// update. Stations are picked by a hash of their EUI and the package, so
+	// raising the percentage keeps the stations already picked.
+	Rollout int
+
+	Data []byte
+}
+
+// matches reports whether the station of version v should get the update
+func (fw *Firmware) matches(eui uint64, v Version) bool {
+	switch {
+	case fw.Model != "" && fw.Model != v.Model:
+		return false
+	case fw.From != "" && fw.From != v.Package:
+		return false
+	case fw.From == "" && comparePackages(v.Package, fw.Package) >= 0:
+		return false
+	case fw.Firmware != "" && fw.Firmware != v.Firmware:
+		return false
+	}
+
+	return inRollout(eui, fw.Package, fw.Rollout)
+}
+
+// comparePackages orders dotted package versions such as 2.0.10, numeric
+// parts by value and the others lexically. An empty version is not older
+// than any other, stations not reporting their package are left alone.
+func comparePackages(a, b string) int {
+	if a == "" || b == "" {
+		return 0
+	}
+
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		// A missing part counts as 0, 1.0 is 1.0.0
+		x, y := "0", "0"
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+
+		xn, xerr := strconv.ParseUint(x, 10, 64)
+		yn, yerr := strconv.ParseUint(y, 10, 64)
+		switch {
+		case xerr == nil && yerr == nil && xn < yn:
+			return -1
+		case xerr == nil && yerr == nil && xn > yn:
+			return 1
+		case xerr != nil || yerr != nil:
+			if c := strings.Compare(x, y); c != 0 {
+				return c
+			}
+		}
+	}
+
+	return 0
+}
+
+// inRollout picks percent of the stations for a release
+func inRollout(eui uint64, release string, percent int) bool {
+	b := make([]byte, 8, 8+len(release))
+	binary.BigEndian.PutUint64(b, eui)
+	b = append(b, release...)
+
+	return int(hash64(b)%100) < percent
+}
+
+// FirmwareStore hands out signed firmware updates through CUPS
+type FirmwareStore struct {
+	// Registry, if set, provides the firmware of stations connected to the
+	// muxs, the update info request does not carry it
+	Registry *Registry
+
+	keys []*SigningKey
+
+	mu      sync.RWMutex
+	updates []*Firmware
+	sigs    map[sigKey][]byte
+}
+
+// sigKey identifies a signature of an update by a key
+type sigKey struct {
+	fw  *Firmware
+	crc uint32
+}
+
+// NewFirmwareStore returns a store signing updates with the given keys
+func NewFirmwareStore(keys ...*SigningKey) *FirmwareStore {
+	return &FirmwareStore{keys: keys}
+}
+
+// Add adds an update, the first added update matching a station wins
+func (fs *FirmwareStore) Add(fw Firmware) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.updates = append(fs.updates, &fw)
+}
+
+// SetRollout changes the rollout percentage of the updates installing a
+// package
+func (fs *FirmwareStore) SetRollout(pkg string, percent int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, fw := range fs.updates {
+		if fw.Package == pkg {
+			fw.Rollout = percent
+		}
+	}
+}
+
+// Find returns the update for a station, nil if there is none
+func (fs *FirmwareStore) Find(eui uint64, v Version) *Firmware {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	for _, fw := range fs.updates {
+		if fw.matches(eui, v) {
+			return fw
+		}
+	}
+	return nil
+}
+
+// Apply adds the update for the requesting station to a CUPS response.
+// Updates are only sent signed with a key the station listed, stations
+// without a matching key are left alone.
+func (fs *FirmwareStore) Apply(req CUPSRequest, resp *CUPSResponse) error {
+	v := Version{Station: req.Station, Model: req.Model, Package: req.Package}
+	if fs.Registry != nil {
+		if gw, ok := fs.Registry.Get(req.Router.EUI); ok {
+			v.Firmware = gw.Version.Firmware
+		}
+	}
+
+	fw := fs.Find(req.Router.EUI, v)
+	if fw == nil {
+		return nil
+	}
+
+	key := fs.keyFor(req.Keys)
+	if key == nil {
+		return nil
+	}
+
+	sig, err := fs.signature(fw, key)
+	if err != nil {
+		return err
+	}
+
+	resp.Update = fw.Data
+	resp.KeyCRC = key.CRC()
+	resp.Signature = sig
+
+	return nil
+}
+
+// keyFor returns the first store key the station can verify
+func (fs *FirmwareStore) keyFor(crcs []uint32) *SigningKey {
+	for _, k := range fs.keys {
+		for _, crc := range crcs {
+			if k.CRC() == crc {
+				return k
+			}
+		}
+	}
+	return nil
+}
+
+// signature returns the cached signature of an update
+func (fs *FirmwareStore) signature(fw *Firmware, key *SigningKey) ([]byte, error) {
+	sk := sigKey{fw: fw, crc: key.CRC()}
+
+	fs.mu.RLock()
+	sig, ok := fs.sigs[sk]
+	fs.mu.RUnlock()
+	if ok {
+		return sig, nil
+	}
+
+	sig, err := key.Sign(fw.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	if fs.sigs == nil {
+		fs.sigs = make(map[sigKey][]byte)
+	}
+	fs.sigs[sk] = sig
+	fs.mu.Unlock()
+
+	return sig, nil
+}
@@ -0,0 +1,192 @@
+package basicstation
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/pem"
+	"hash/crc32"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+)
+
+// writeSigningKey generates a P-256 key file in dir
+func writeSigningKey(t *testing.T, dir, name string) string {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestFirmwareSigning(t *testing.T) {
+
+	dir := t.TempDir()
+	key1, err := LoadSigningKey(writeSigningKey(t, dir, "sig-0.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := LoadSigningKey(writeSigningKey(t, dir, "sig-1.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key1.CRC() != crc32.ChecksumIEEE(key1.StationKey()) || len(key1.StationKey()) != 64 {
+		t.Fatalf("key crc %x does not match the station key", key1.CRC())
+	}
+
+	fs := NewFirmwareStore(key1, key2)
+	fs.Add(Firmware{Model: "linux", Package: "2.0.0", Rollout: 100, Data: []byte("update")})
+
+	req := CUPSRequest{
+		Router:  RouterID{EUI: 1},
+		Model:   "linux",
+		Package: "1.0.0",
+		Keys:    []uint32{0xdeadbeef, key2.CRC()},
+	}
+
+	var resp CUPSResponse
+	if err := fs.Apply(req, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Update) != "update" || resp.KeyCRC != key2.CRC() {
+		t.Fatalf("response got update %q key %x, want key %x", resp.Update, resp.KeyCRC, key2.CRC())
+	}
+
+	// Verify the way a station does, with the raw public key
+	raw := key2.StationKey()
+	pub := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(raw[:32]),
+		Y:     new(big.Int).SetBytes(raw[32:]),
+	}
+	digest := sha512.Sum512(resp.Update)
+	if !ecdsa.VerifyASN1(pub, digest[:], resp.Signature) {
+		t.Errorf("signature does not verify")
+	}
+
+	tcs := []struct {
+		name string
+		req  CUPSRequest
+	}{
+		{"up to date", CUPSRequest{Model: "linux", Package: "2.0.0", Keys: []uint32{key1.CRC()}}},
+		{"newer", CUPSRequest{Model: "linux", Package: "2.0.10", Keys: []uint32{key1.CRC()}}},
+		{"unknown package", CUPSRequest{Model: "linux", Keys: []uint32{key1.CRC()}}},
+		{"other model", CUPSRequest{Model: "rpi", Package: "1.0.0", Keys: []uint32{key1.CRC()}}},
+		{"unknown keys", CUPSRequest{Model: "linux", Package: "1.0.0", Keys: []uint32{1}}},
+	}
+	for _, tt := range tcs {
+		var resp CUPSResponse
+		if err := fs.Apply(tt.req, &resp); err != nil || resp.Update != nil {
+			t.Errorf("%s: got update %q, %v", tt.name, resp.Update, err)
+		}
+	}
+}
+
+func TestComparePackages(t *testing.T) {
+
+	tcs := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0.0", "2.0.0", -1},
+		{"2.0.9", "2.0.10", -1},
+		{"2.1", "2.0.10", 1},
+		{"1.0", "1.0.0", 0},
+		{"1.0.0-rc1", "1.0.0-rc2", -1},
+		{"", "1.0.0", 0},
+	}
+	for _, tt := range tcs {
+		if got := comparePackages(tt.a, tt.b); got != tt.want {
+			t.Errorf("comparePackages(%q, %q) got %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+
+	// From pins the package an update applies to
+	fw := Firmware{Package: "1.0.0", From: "2.0.0", Rollout: 100}
+	if !fw.matches(1, Version{Package: "2.0.0"}) || fw.matches(1, Version{Package: "3.0.0"}) {
+		t.Errorf("update from %s matched the wrong packages", fw.From)
+	}
+}
+
+func TestFirmwareRollout(t *testing.T) {
+
+	fs := NewFirmwareStore()
+	fs.Add(Firmware{Package: "2.0.0", Rollout: 30})
+
+	v := Version{Package: "1.0.0"}
+	const stations = 2000
+
+	picked := make(map[uint64]bool)
+	for eui := uint64(1); eui <= stations; eui++ {
+		if fs.Find(eui, v) != nil {
+			picked[eui] = true
+		}
+	}
+	if n := len(picked); n < stations*20/100 || n > stations*40/100 {
+		t.Errorf("30%% rollout picked %d of %d stations", n, stations)
+	}
+
+	// Raising the rollout keeps the stations already picked
+	fs.SetRollout("2.0.0", 60)
+	n := 0
+	for eui := uint64(1); eui <= stations; eui++ {
+		got := fs.Find(eui, v) != nil
+		if picked[eui] && !got {
+			t.Fatalf("station %d dropped from the rollout", eui)
+		}
+		if got {
+			n++
+		}
+	}
+	if n < stations*50/100 || n > stations*70/100 {
+		t.Errorf("60%% rollout picked %d of %d stations", n, stations)
+	}
+
+	fs.SetRollout("2.0.0", 0)
+	if fs.Find(1, v) != nil {
+		t.Errorf("0%% rollout picked a station")
+	}
+}
+
+func TestFirmwareMatchesRunningFirmware(t *testing.T) {
+
+	key, err := LoadSigningKey(writeSigningKey(t, t.TempDir(), "sig-0.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := NewRegistry(DuplicateKickOld)
+	reg.add(&Gateway{EUI: 1, Version: Version{Firmware: "fw-1"}})
+
+	fs := NewFirmwareStore(key)
+	fs.Registry = reg
+	fs.Add(Firmware{Package: "2.0.0", Firmware: "fw-1", Rollout: 100, Data: []byte("update")})
+
+	for eui, want := range map[uint64]bool{1: true, 2: false} {
+		var resp CUPSResponse
+		req := CUPSRequest{Router: RouterID{EUI: eui}, Package: "1.0.0", Keys: []uint32{key.CRC()}}
+		if err := fs.Apply(req, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.Update != nil; got != want {
+			t.Errorf("station %d got update %v, want %v", eui, got, want)
+		}
+	}
+}
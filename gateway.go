@@ -5,28 +5,56 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"io/ioutil"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-// Stats provides some basic statistics
-type Stats struct {
-	DecodeErrors     uint
-	RecvTextMsg      uint
-	RecvBinaryMsg    uint
-	WriteNoConnError uint
-	WriteTextOk      uint
-	WriteTextError   uint
-}
-
 // Gateway will be the next gateway interface
 type Gateway struct {
+	// stats comes first for the 64-bit alignment of its atomic counters
+	stats gatewayStats
+
 	EUI        uint64
 	conn       *websocket.Conn
 	Version    Version
 	RouterConf RouterConf
-	Stats      Stats
+
+	// Capabilities are the features advertised in Version.Features
+	Capabilities Capabilities
+
+	// Identity is the authenticated identity of the station, zero if the
+	// GatewayHandler has no Authenticator
+	Identity Identity
+
+	// TimeSyncInterval enables unsolicited timesync messages when non zero
+	TimeSyncInterval time.Duration
+
+	// OutboundQueueSize is the capacity of the downlink and housekeeping
+	// outbound queues, DefaultOutboundQueueSize if zero
+	OutboundQueueSize int
+
+	// WriteTimeout is the write deadline of a message, DefaultWriteTimeout
+	// if zero
+	WriteTimeout time.Duration
+
+	// PingInterval is the interval between websocket pings,
+	// DefaultPingInterval if zero and no keepalive if negative
+	PingInterval time.Duration
+
+	// PongTimeout is how long the station has to answer a ping before the
+	// connection is closed, DefaultPongTimeout if zero
+	PongTimeout time.Duration
+
+	registry  *Registry
+	pending   pendingTxs
+	timeRef   timeRef
+	roundTrip roundTrip
+	shells    remoteShells
+	out       *outboundQueue
+	outOnce   sync.Once
 }
 
 // Logger interface
@@ -45,8 +73,12 @@ type Handler interface {
 func (gw *Gateway) Run(ctx context.Context, handler Handler, log Logger) error {
 	var err error
 
-	// Close the connection on exit
+	gw.stats.start(time.Now())
+	defer func() { gw.stats.stop(time.Now()) }()
+
+	// Close the connection and the remote shell sessions on exit
 	defer gw.conn.Close()
+	defer gw.shells.closeAll()
 
 	// First message from the gateway is it's version information
 	if err = gw.readVersion(ctx); err != nil {
@@ -54,57 +86,122 @@ func (gw *Gateway) Run(ctx context.Context, handler Handler, log Logger) error {
 		return err
 	}
 
+	// Reject stations speaking a protocol version we do not support
+	if err = checkProtocol(gw.Version); err != nil {
+		log.Error(gw.EUI, err, "station rejected")
+		gw.sendClose(websocket.ClosePolicyViolation, err.Error())
+		return err
+	}
+
 	// Get router configuration from the server
 	if err = handler.GetRouterConf(gw); err != nil {
 		return err
 	}
 
-	// Send config to the gateway
-	outbound, err := gw.conn.NextWriter(websocket.TextMessage)
-	if err != nil {
-		// websocket closed
-		log.Debug(gw.EUI, "websocket closed", nil)
+	// The station only rejects a bad configuration once it is running
+	if err = gw.RouterConf.Validate(); err != nil {
+		log.Error(gw.EUI, err, "router configuration rejected")
+		gw.sendClose(websocket.CloseInternalServerErr, "invalid router_config")
 		return err
 	}
 
-	enc := json.NewEncoder(outbound)
-	if err = enc.Encode(&gw.RouterConf); err != nil {
-		// websocket closed
+	// Helper goroutines run until Run returns
+	stop := make(chan struct{})
+	defer close(stop)
+
+	// Send config to the gateway before the writer starts, nothing queued
+	// can overtake it
+	if err = gw.writeRouterConf(); err != nil {
+		log.Debug(gw.EUI, "send router configuration failed", err)
 		return err
 	}
-	// Closing the writer does the send
-	outbound.Close()
 
-	done := make(chan bool)
+	// gorilla/websocket supports a single concurrent writer, every message
+	// goes through the outbound queue drained by this goroutine
+	go gw.runWriter(stop, log)
+
+	// Only a configured session is visible to registry users
+	if gw.registry != nil {
+		if err = gw.registry.register(gw, log); err != nil {
+			return err
+		}
+		defer gw.registry.remove(gw)
+	}
+
+	// Closed by the reader goroutine when it exits
+	done := make(chan struct{})
+
+	if gw.TimeSyncInterval > 0 {
+		go gw.runTimeSync(stop, log)
+	}
+
+	// Detect stations that silently dropped off the network
+	gw.startKeepalive(stop, log)
 
 	// Read message loop
 	go func() {
+		defer close(done)
+
 		for {
 			var mt int
 			var inbound io.Reader
 
 			mt, inbound, err = gw.conn.NextReader()
 			if err != nil {
-				log.Debug(gw.EUI, "websocket reader detected close", nil)
-				done <- true
+				if gw.peerTimedOut(err, log) {
+					err = ErrPeerTimeout
+				} else {
+					log.Debug(gw.EUI, "websocket reader detected close", nil)
+				}
 				return
 			}
+			gw.extendReadDeadline()
 
 			switch mt {
 			case websocket.TextMessage:
 				var msg interface{}
 
-				msg, err = decode(inbound)
+				in := &countingReader{r: inbound}
+				msg, err = decode(in)
 				if err != nil {
-					gw.Stats.DecodeErrors++
+					gw.stats.decodeError(err, in.n)
 					log.Error(gw.EUI, err, "decode message failed")
 					continue
 				}
+				gw.stats.received(msgTypeOf(msg), in.n)
+				gw.measureRoundTrip(refTime(msg), time.Now())
+
+				switch m := msg.(type) {
+				case TimeSync:
+					// Answered here, the handler never sees timesync requests
+					if err := gw.answerTimeSync(m); err != nil {
+						log.Error(gw.EUI, err, "answer timesync failed")
+					}
+					continue
+				case DnTxed:
+					m = gw.pending.confirm(m)
+					if m.Downlink != nil {
+						gw.stats.add(&gw.stats.downlinksConfirmed, 1)
+					}
+					msg = m
+				case Uplink:
+					gw.timeRef.received(m.UpInfo.RCtx, time.Now())
+				case JoinRequest:
+					gw.timeRef.received(m.UpInfo.RCtx, time.Now())
+				case ProprietaryFrame:
+					gw.timeRef.received(m.UpInfo.RCtx, time.Now())
+				}
 				handler.Receive(gw, msg)
 			case websocket.BinaryMessage:
-				// Binary data sent by RPC sessions
-				gw.Stats.RecvBinaryMsg++
-				log.Debug(gw.EUI, "received websocket binary data", nil)
+				// Binary data sent by remote shell sessions
+				frame, rerr := ioutil.ReadAll(inbound)
+				gw.stats.receivedBinary(len(frame))
+				if rerr == nil {
+					rerr = gw.shells.deliver(frame)
+				}
+				if rerr != nil {
+					log.Debug(gw.EUI, "remote shell data not delivered", rerr)
+				}
 			case websocket.CloseMessage:
 				err = errors.New("received websocket close")
 				log.Debug(gw.EUI, "lost connection", err)
@@ -117,6 +214,9 @@ func (gw *Gateway) Run(ctx context.Context, handler Handler, log Logger) error {
 	for {
 		select {
 		case <-ctx.Done():
+			// Unblock the reader and wait for it to exit
+			gw.conn.Close()
+			<-done
 			return ctx.Err()
 		case <-done:
 			return err
@@ -126,23 +226,71 @@ func (gw *Gateway) Run(ctx context.Context, handler Handler, log Logger) error {
 	return err
 }
 
-// WriteJSON writes json encoded message to websocket
-func (gw Gateway) WriteJSON(msg interface{}) error {
+// WriteJSON queues a json encoded message for the websocket writer. It is
+// safe for concurrent use, downlinks and timesync replies are sent ahead of
+// other messages and ErrOutboundQueueFull is returned when the queue is at
+// capacity.
+func (gw *Gateway) WriteJSON(msg interface{}) error {
 	if gw.conn == nil {
-		gw.Stats.WriteNoConnError++
+		gw.stats.add(&gw.stats.writeNoConn, 1)
 		return errors.New("no connection")
 	}
 
-	err := gw.conn.WriteJSON(msg)
+	b, err := json.Marshal(msg)
 	if err != nil {
-		gw.Stats.WriteTextError++
-	} else {
-		gw.Stats.WriteTextOk++
+		return err
+	}
+
+	return gw.outbound().put(outboundMsg{
+		mt:        websocket.TextMessage,
+		data:      b,
+		msgType:   msgTypeOf(msg),
+		downlinks: downlinkCount(msg),
+		urgent:    isUrgent(msg),
+	})
+}
+
+// writeRouterConf writes the router configuration directly, Run calls it
+// before the writer starts
+func (gw *Gateway) writeRouterConf() error {
+	b, err := json.Marshal(&gw.RouterConf)
+	if err != nil {
+		return err
 	}
 
+	return gw.write(outboundMsg{
+		mt:      websocket.TextMessage,
+		data:    b,
+		msgType: RouterConfMsgName,
+	})
+}
+
+// writeBinary queues a binary frame for the websocket writer
+func (gw *Gateway) writeBinary(b []byte) error {
+	if gw.conn == nil {
+		gw.stats.add(&gw.stats.writeNoConn, 1)
+		return errors.New("no connection")
+	}
+
+	return gw.outbound().put(outboundMsg{mt: websocket.BinaryMessage, data: b})
+}
+
+// Close ends the session, the close frame tells the station why
+func (gw *Gateway) Close(code int, reason string) error {
+	err := gw.sendClose(code, reason)
+	gw.conn.Close()
+
 	return err
 }
 
+// sendClose starts the websocket closing handshake, the session ends once
+// the station answers with its own close frame
+func (gw *Gateway) sendClose(code int, reason string) error {
+	return gw.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(time.Second))
+}
+
 func (gw *Gateway) readVersion(ctx context.Context) error {
 
 	// Set a short initial read deadline to abort the connection if version is not soon received
@@ -162,5 +310,7 @@ func (gw *Gateway) readVersion(ctx context.Context) error {
 		return err
 	}
 
+	gw.Capabilities = ParseCapabilities(gw.Version.Features)
+
 	return nil
 }
@@ -8,4 +8,5 @@ require (
 	github.com/mitchellh/mapstructure v1.4.1
 	github.com/rs/zerolog v1.22.0
 	github.com/shaunybear/lorawango v0.0.0-20210428121225-87a347d3fff1
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 )
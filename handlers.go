@@ -11,20 +11,29 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
-	lorawan "github.com/shaunybear/lorawango"
 )
 
 const (
 	// DiscoveryURL is the Discovery URL path
 	DiscoveryURL     = "/router-info"
 	discoveryTimeout = 5 * time.Second
+
+	// maxCloseReason is the longest reason that fits a close frame payload
+	maxCloseReason = 123
 )
 
+// ErrUnknownGateway is returned by Server.GetDiscoveryResponse for gateways
+// the server does not serve, the station is told so
+var ErrUnknownGateway = errors.New("unknown gateway")
+
 var upgrader = websocket.Upgrader{}
 
 // GatewayHandler is the Basic Station HTTP handler
 type GatewayHandler struct {
 	Env *Environment
+
+	// Auth, if set, authenticates stations before the websocket upgrade
+	Auth Authenticator
 }
 
 func (gh GatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -39,7 +48,8 @@ func (gh GatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			Msg("malformed muxs request uri")
 	}
 
-	eui, err := lorawan.NewEUI(v)
+	// Stations may identify themselves by EUI, ID6 or integer
+	id, err := ParseRouterID(v)
 	if err != nil {
 		gh.Env.Log.Debug().
 			Err(err).
@@ -47,7 +57,49 @@ func (gh GatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			Msg("parse eui from url failed")
 		return
 	}
-	gw.EUI = eui.Uint64()
+	gw.EUI = id.EUI
+
+	if gh.Env.sessions.isClosing() {
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	// The address and session limits come first, before any costly
+	// authentication
+	adm := gh.Env.Admission
+	if adm != nil {
+		release, err := adm.admitGateway(r)
+		if err != nil {
+			rej := err.(Rejection)
+			gh.Env.rejected(rej, r).Str("gweui", v).Msg("muxs connection rejected")
+			reject(w, rej)
+			return
+		}
+		defer release()
+	}
+
+	if gh.Auth != nil {
+		gw.Identity, err = authenticate(gh.Auth, gw.EUI, w, r)
+		if err != nil {
+			gh.Env.Log.Warn().
+				Err(err).
+				Str("gweui", v).
+				Str("remote", r.RemoteAddr).
+				Msg("gateway authentication failed")
+			return
+		}
+	}
+
+	// The EUI is only charged once authenticated, a caller claiming the EUI
+	// of another gateway cannot lock it out
+	if adm != nil {
+		if err := adm.admitEUI(gw.EUI); err != nil {
+			rej := err.(Rejection)
+			gh.Env.rejected(rej, r).Str("gweui", v).Msg("muxs connection rejected")
+			reject(w, rej)
+			return
+		}
+	}
 
 	gw.conn, err = upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -58,26 +110,107 @@ func (gh GatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	defer gw.conn.Close()
 
+	// Shutdown may have started during the upgrade
+	if !gh.Env.sessions.add(&gw) {
+		gw.sendClose(websocket.CloseGoingAway, "server shutting down")
+		return
+	}
+	defer gh.Env.sessions.remove(&gw)
+
+	// The session is registered by Run once the station is configured
+	gw.registry = gh.Env.Registry
+
 	// Pass gateway to the server to do with it as it pleases
 	gh.Env.Server.NewConnection(&gw)
 }
 
 // DiscoveryResponse represents a discovery response message
 type DiscoveryResponse struct {
+	// Router is filled in by DiscoveryHandler, servers need not set it. The
+	// response echoes the router id in the notation the station used.
 	Router string `json:"router,omitempty"`
 	URI    string `json:"uri,omitempty"`
 	MUXS   string `json:"muxs,omitempty"`
 	Error  string `json:"error,omitempty"`
+
+	router *RouterID
+}
+
+type discoveryResponse DiscoveryResponse
+
+// echo sets the router id of the request to be sent back to the station
+func (response *DiscoveryResponse) echo(id *RouterID) {
+	response.Router = id.String()
+	response.router = id
+}
+
+// MarshalJSON encodes the router id as received, an integer id stays a number
+func (response DiscoveryResponse) MarshalJSON() ([]byte, error) {
+	if response.router == nil {
+		return json.Marshal(discoveryResponse(response))
+	}
+
+	return json.Marshal(struct {
+		Router *RouterID `json:"router"`
+		discoveryResponse
+	}{response.router, discoveryResponse(response)})
+}
+
+// UnmarshalJSON accepts a router id sent as a string or a number
+func (response *DiscoveryResponse) UnmarshalJSON(b []byte) error {
+	var v struct {
+		Router json.RawMessage `json:"router"`
+		discoveryResponse
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	*response = DiscoveryResponse(v.discoveryResponse)
+	if len(v.Router) == 0 || string(v.Router) == "null" {
+		return nil
+	}
+
+	if err := json.Unmarshal(v.Router, &response.Router); err != nil {
+		var n json.Number
+		if err := json.Unmarshal(v.Router, &n); err != nil {
+			return err
+		}
+		response.Router = n.String()
+	}
+	return nil
 }
 
 // DiscoveryHandler is the Basic Station Discovery HTTP handler
 type DiscoveryHandler struct {
 	Env *Environment
+
+	// Balancer, if set, spreads stations over several muxs backends, its
+	// pick replaces the muxs of Server.GetDiscoveryResponse
+	Balancer Balancer
+
+	// Auth, if set, authenticates stations once their router id is known,
+	// such as CertAuthenticator checking the client certificate EUI
+	Auth Authenticator
 }
 
 func (handler DiscoveryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var response DiscoveryResponse
 
+	if handler.Env.sessions.isClosing() {
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	if adm := handler.Env.Admission; adm != nil {
+		if err := adm.admitIP(remoteIP(r)); err != nil {
+			rej := err.(Rejection)
+			handler.Env.rejected(rej, r).Msg("discovery connection rejected")
+			reject(w, rej)
+			return
+		}
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		handler.Env.Log.Error().Err(err).Msg("discovery websocket upgrader")
@@ -92,49 +225,126 @@ func (handler DiscoveryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 	_, reader, err := conn.NextReader()
 	if err != nil {
 		handler.Env.Log.Error().Err(err).Msg("discovery websocket next reader")
+		handler.reply(conn, DiscoveryResponse{Error: "no discovery request received"}, websocket.ClosePolicyViolation)
 		return
 	}
 
 	msg, err := handler.decode(reader)
 	if err != nil {
 		handler.Env.Log.Warn().Err(err).Msg("discovery decode json")
+		handler.reply(conn, DiscoveryResponse{Error: "malformed request: " + err.Error()}, websocket.CloseUnsupportedData)
 		return
 	}
 
-	// Extract EUI from the request
-	var eui lorawan.EUI
+	// Extract the router id, an EUI, ID6 or integer, from the request
+	var id *RouterID
 	for k, v := range msg {
 		switch k {
 		case "router", "Router":
-			eui, err = lorawan.NewEUI(v)
+			parsed, err := ParseRouterID(v)
 			if err != nil {
-				response.Error = "Missing router field"
-				conn.WriteJSON(&response)
 				handler.Env.Log.Warn().Err(err).Msg("discovery request get eui")
+				handler.reply(conn, DiscoveryResponse{Error: "malformed router id"}, websocket.CloseUnsupportedData)
 				return
 			}
-			response.Router = eui.String()
+			id = &parsed
 		default:
-			handler.Env.Log.Warn().Err(err).Msg("discovery request no eui")
+			handler.Env.Log.Warn().Str("field", k).Msg("discovery request unexpected field")
+			handler.reply(conn, DiscoveryResponse{Error: fmt.Sprintf("malformed request: unexpected field %q", k)}, websocket.CloseUnsupportedData)
 			return
 		}
 	}
 
-	response, err = handler.Env.Server.GetDiscoveryResponse(eui.Uint64(), r)
+	if id == nil {
+		handler.Env.Log.Warn().Msg("discovery request no eui")
+		handler.reply(conn, DiscoveryResponse{Error: "missing router field"}, websocket.CloseUnsupportedData)
+		return
+	}
 
-	// Write response
-	writer, err := conn.NextWriter(websocket.TextMessage)
-	defer writer.Close()
+	if handler.Auth != nil {
+		if _, err := handler.Auth.Authenticate(id.EUI, r); err != nil {
+			handler.Env.Log.Warn().
+				Err(err).
+				Str("router", id.String()).
+				Str("remote", r.RemoteAddr).
+				Msg("discovery authentication failed")
+			reason := "forbidden"
+			if errors.Is(err, ErrUnauthorized) {
+				reason = "unauthorized"
+			}
+			response.echo(id)
+			response.Error = reason
+			handler.reply(conn, response, websocket.ClosePolicyViolation)
+			return
+		}
+	}
 
-	if err != nil {
-		handler.Env.Log.Error().Err(err).Msg("discovery next writer")
-		return
+	// The router id is only known after the upgrade and charged once
+	// authenticated, the station is told to back off in the response
+	if adm := handler.Env.Admission; adm != nil {
+		if err := adm.admitEUI(id.EUI); err != nil {
+			rej := err.(Rejection)
+			handler.Env.rejected(rej, r).Str("router", id.String()).Msg("discovery request rejected")
+			reason := fmt.Sprintf("%s, retry after %d s", rej.Reason, rej.retryAfterSeconds())
+			response.echo(id)
+			response.Error = reason
+			handler.reply(conn, response, websocket.CloseTryAgainLater)
+			return
+		}
+	}
+
+	code := websocket.CloseNormalClosure
+
+	// The server decides whether the gateway is known, the balancer only
+	// picks its muxs
+	response, err = handler.Env.Server.GetDiscoveryResponse(id.EUI, r)
+	if err == nil && handler.Balancer != nil {
+		var backend Backend
+		if backend, err = handler.Balancer.Pick(id.EUI); err == nil {
+			picked := backend.Response(id.EUI)
+			response.URI, response.MUXS = picked.URI, picked.MUXS
+		}
+	}
+
+	switch {
+	case errors.Is(err, ErrNoBackend):
+		handler.Env.Log.Error().Err(err).Str("router", id.String()).Msg("discovery balancer")
+		response = DiscoveryResponse{Error: "no muxs available"}
+		code = websocket.CloseTryAgainLater
+	case errors.Is(err, ErrUnknownGateway):
+		handler.Env.Log.Info().Str("router", id.String()).Msg("discovery request from unknown gateway")
+		response = DiscoveryResponse{Error: "unknown gateway"}
+		code = websocket.ClosePolicyViolation
+	case err != nil:
+		// Internal errors are logged, not reported to the station
+		handler.Env.Log.Error().Err(err).Str("router", id.String()).Msg("get discovery response")
+		response = DiscoveryResponse{Error: "server error"}
+		code = websocket.CloseInternalServerErr
 	}
 
-	enc := json.NewEncoder(writer)
-	if err = enc.Encode(&response); err != nil {
+	// Whatever router the server set, the request's id is echoed
+	response.echo(id)
+
+	handler.reply(conn, response, code)
+}
+
+// reply sends the discovery response and closes the connection with code
+func (handler DiscoveryHandler) reply(conn *websocket.Conn, response DiscoveryResponse, code int) {
+	conn.SetWriteDeadline(time.Now().Add(discoveryTimeout))
+
+	if err := conn.WriteJSON(&response); err != nil {
 		handler.Env.Log.Error().Err(err).Msg("send discovery response")
+		return
 	}
+
+	reason := response.Error
+	if len(reason) > maxCloseReason {
+		reason = reason[:maxCloseReason]
+	}
+
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(time.Second))
 }
 
 func (handler DiscoveryHandler) decode(r io.Reader) (map[string]interface{}, error) {
@@ -143,7 +353,11 @@ func (handler DiscoveryHandler) decode(r io.Reader) (map[string]interface{}, err
 	var msg string
 
 	m := make(map[string]interface{})
-	err := json.NewDecoder(r).Decode(&m)
+
+	// Numbers are kept as json.Number, integer router ids do not fit float64
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	err := dec.Decode(&m)
 	if err == nil {
 		return m, nil
 	}
@@ -0,0 +1,277 @@
+package basicstation
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// IDFormat is the notation of a router identifier
+type IDFormat int
+
+const (
+	// EUIFormat is the dashed EUI notation, 01-02-03-04-05-06-07-08
+	EUIFormat IDFormat = iota
+	// HexFormat is 16 hex digits, 0102030405060708
+	HexFormat
+	// ID6Format is the IPv6 like notation of four 16 bit groups, 102:304:506:708
+	ID6Format
+	// IntFormat is a decimal integer
+	IntFormat
+)
+
+// RouterID is a router identifier with the notation the station used, so
+// replies can echo it back in the same form
+type RouterID struct {
+	EUI    uint64
+	Format IDFormat
+
+	// raw is the json encoding of the identifier as parsed, empty if the
+	// identifier was not parsed
+	raw string
+}
+
+// MalformedID error
+type MalformedID struct {
+	id interface{}
+}
+
+// Error satisifies error interface
+func (m MalformedID) Error() string {
+	return fmt.Sprintf("malformed router id: %v", m.id)
+}
+
+// ParseRouterID parses an EUI, ID6 or integer router identifier. Integers
+// may be given as numbers or decimal strings, a 16 digit string is an EUI.
+func ParseRouterID(v interface{}) (RouterID, error) {
+	id, err := parseRouterID(v)
+	if err != nil {
+		return RouterID{}, err
+	}
+
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return RouterID{}, MalformedID{id: v}
+	}
+	id.raw = string(raw)
+
+	return id, nil
+}
+
+func parseRouterID(v interface{}) (RouterID, error) {
+	switch v := v.(type) {
+	case string:
+		return parseRouterIDString(v)
+	case json.Number:
+		n, err := strconv.ParseUint(v.String(), 10, 64)
+		if err != nil {
+			return RouterID{}, MalformedID{id: v}
+		}
+		return RouterID{EUI: n, Format: IntFormat}, nil
+	case float64:
+		// Integers above 2^53 lose precision as float64
+		if v < 0 || v > 1<<53 || v != math.Trunc(v) {
+			return RouterID{}, MalformedID{id: v}
+		}
+		return RouterID{EUI: uint64(v), Format: IntFormat}, nil
+	case int:
+		if v < 0 {
+			return RouterID{}, MalformedID{id: v}
+		}
+		return RouterID{EUI: uint64(v), Format: IntFormat}, nil
+	case uint64:
+		return RouterID{EUI: v, Format: IntFormat}, nil
+	}
+
+	return RouterID{}, MalformedID{id: v}
+}
+
+func parseRouterIDString(s string) (RouterID, error) {
+	switch {
+	case len(s) == 16 && isHex(s):
+		n, err := strconv.ParseUint(s, 16, 64)
+		if err == nil {
+			return RouterID{EUI: n, Format: HexFormat}, nil
+		}
+	case strings.Count(s, "-") == 7:
+		if n, ok := parseBytes(strings.Split(s, "-")); ok {
+			return RouterID{EUI: n, Format: EUIFormat}, nil
+		}
+	case strings.Count(s, ":") == 7:
+		// Colon separated bytes rather than ID6 groups
+		if n, ok := parseBytes(strings.Split(s, ":")); ok {
+			return RouterID{EUI: n, Format: EUIFormat}, nil
+		}
+	case strings.Contains(s, ":"):
+		n, err := ParseID6(s)
+		if err == nil {
+			return RouterID{EUI: n, Format: ID6Format}, nil
+		}
+	case s != "" && strings.Trim(s, "0123456789") == "":
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err == nil {
+			return RouterID{EUI: n, Format: IntFormat}, nil
+		}
+	}
+
+	return RouterID{}, MalformedID{id: s}
+}
+
+// parseBytes parses eight two digit hex bytes
+func parseBytes(parts []string) (uint64, bool) {
+	var n uint64
+	for _, p := range parts {
+		if len(p) != 2 || !isHex(p) {
+			return 0, false
+		}
+		b, _ := strconv.ParseUint(p, 16, 8)
+		n = n<<8 | b
+	}
+	return n, true
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseID6 parses an ID6, four groups of up to four hex digits separated by
+// colons. As in IPv6 one run of zero groups may be abbreviated to ::.
+func ParseID6(s string) (uint64, error) {
+	var groups []string
+
+	switch halves := strings.Split(s, "::"); len(halves) {
+	case 1:
+		groups = strings.Split(s, ":")
+		if len(groups) != 4 {
+			return 0, MalformedID{id: s}
+		}
+	case 2:
+		var head, tail []string
+		if halves[0] != "" {
+			head = strings.Split(halves[0], ":")
+		}
+		if halves[1] != "" {
+			tail = strings.Split(halves[1], ":")
+		}
+		if len(head)+len(tail) > 3 {
+			return 0, MalformedID{id: s}
+		}
+		groups = append(head, make([]string, 4-len(head)-len(tail))...)
+		for i := len(head); i < 4-len(tail); i++ {
+			groups[i] = "0"
+		}
+		groups = append(groups, tail...)
+	default:
+		return 0, MalformedID{id: s}
+	}
+
+	var n uint64
+	for _, g := range groups {
+		if len(g) == 0 || len(g) > 4 || !isHex(g) {
+			return 0, MalformedID{id: s}
+		}
+		v, _ := strconv.ParseUint(g, 16, 16)
+		n = n<<16 | v
+	}
+
+	return n, nil
+}
+
+// FormatID6 formats an EUI as ID6, abbreviating the longest run of two or
+// more zero groups. Zero is ::0.
+func FormatID6(eui uint64) string {
+	var groups [4]uint64
+	for i := range groups {
+		groups[i] = eui >> (48 - 16*uint(i)) & 0xffff
+	}
+
+	// Longest run of zero groups, the first one on a tie
+	start, length := -1, 0
+	for i := 0; i < 4; {
+		if groups[i] != 0 {
+			i++
+			continue
+		}
+		j := i
+		for j < 4 && groups[j] == 0 {
+			j++
+		}
+		if j-i > length {
+			start, length = i, j-i
+		}
+		i = j
+	}
+
+	hex := func(gs []uint64) string {
+		parts := make([]string, len(gs))
+		for i, g := range gs {
+			parts[i] = strconv.FormatUint(g, 16)
+		}
+		return strings.Join(parts, ":")
+	}
+
+	switch {
+	case length == 4:
+		return "::0"
+	case length < 2:
+		return hex(groups[:])
+	}
+
+	return hex(groups[:start]) + "::" + hex(groups[start+length:])
+}
+
+// String returns the identifier in its notation
+func (id RouterID) String() string {
+	switch id.Format {
+	case HexFormat:
+		return fmt.Sprintf("%016X", id.EUI)
+	case ID6Format:
+		return FormatID6(id.EUI)
+	case IntFormat:
+		return strconv.FormatUint(id.EUI, 10)
+	}
+
+	parts := make([]string, 8)
+	for i := range parts {
+		parts[i] = fmt.Sprintf("%02X", byte(id.EUI>>(56-8*uint(i))))
+	}
+	return strings.Join(parts, "-")
+}
+
+// MarshalJSON encodes a parsed identifier exactly as it was received,
+// others as numbers for integer identifiers and strings otherwise
+func (id RouterID) MarshalJSON() ([]byte, error) {
+	if id.raw != "" {
+		return []byte(id.raw), nil
+	}
+	if id.Format == IntFormat {
+		return []byte(id.String()), nil
+	}
+	return json.Marshal(id.String())
+}
+
+// UnmarshalJSON decodes any router identifier notation
+func (id *RouterID) UnmarshalJSON(b []byte) error {
+	dec := json.NewDecoder(strings.NewReader(string(b)))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+
+	parsed, err := ParseRouterID(v)
+	if err != nil {
+		return err
+	}
+	*id = parsed
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package basicstation
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestID6(t *testing.T) {
+
+	tcs := []struct {
+		id6 string
+		eui uint64
+	}{
+		{"::0", 0},
+		{"::1", 1},
+		{"1::", 0x0001000000000000},
+		{"f::1", 0x000f000000000001},
+		{"::a:b", 0x00000000000a000b},
+		{"1:2:3:4", 0x0001000200030004},
+		{"1:0:2:3", 0x0001000000020003},
+		{"1::2", 0x0001000000000002},
+		{"ffff:ffff:ffff:ffff", 0xffffffffffffffff},
+	}
+
+	for _, tt := range tcs {
+		eui, err := ParseID6(tt.id6)
+		if err != nil || eui != tt.eui {
+			t.Errorf("ParseID6(%q) got %x, %v, want %x", tt.id6, eui, err, tt.eui)
+		}
+		if got := FormatID6(tt.eui); got != tt.id6 {
+			t.Errorf("FormatID6(%x) got %q, want %q", tt.eui, got, tt.id6)
+		}
+	}
+
+	// Non canonical forms parse too
+	for s, eui := range map[string]uint64{"0:0:0:1": 1, "::0:1": 1, "0::": 0, "::": 0} {
+		if got, err := ParseID6(s); err != nil || got != eui {
+			t.Errorf("ParseID6(%q) got %x, %v, want %x", s, got, err, eui)
+		}
+	}
+
+	for _, s := range []string{"1:2:3", "1:2:3:4:5", "1::2::3", "1:2:3:4::", "12345::", "g::1", ":1:2:3"} {
+		if _, err := ParseID6(s); err == nil {
+			t.Errorf("ParseID6(%q) expected error", s)
+		}
+	}
+}
+
+// mustRouterID parses a router identifier as received from a station
+func mustRouterID(v interface{}) *RouterID {
+	id, err := ParseRouterID(v)
+	if err != nil {
+		panic(err)
+	}
+	return &id
+}
+
+func TestParseRouterID(t *testing.T) {
+
+	tcs := []struct {
+		in   interface{}
+		want RouterID
+		text string
+	}{
+		{"0102030405060708", RouterID{EUI: 0x0102030405060708, Format: HexFormat}, "0102030405060708"},
+		{"01-02-03-04-05-06-07-08", RouterID{EUI: 0x0102030405060708, Format: EUIFormat}, "01-02-03-04-05-06-07-08"},
+		{"01:02:03:04:05:06:07:08", RouterID{EUI: 0x0102030405060708, Format: EUIFormat}, "01-02-03-04-05-06-07-08"},
+		{"102:304:506:708", RouterID{EUI: 0x0102030405060708, Format: ID6Format}, "102:304:506:708"},
+		{"72623859790382856", RouterID{EUI: 0x0102030405060708, Format: IntFormat}, "72623859790382856"},
+		{json.Number("72623859790382856"), RouterID{EUI: 0x0102030405060708, Format: IntFormat}, "72623859790382856"},
+		{float64(1), RouterID{EUI: 1, Format: IntFormat}, "1"},
+		{"aa-bb-cc-dd-ee-ff-00-01", RouterID{EUI: 0xaabbccddeeff0001, Format: EUIFormat}, "AA-BB-CC-DD-EE-FF-00-01"},
+	}
+
+	for _, tt := range tcs {
+		id, err := ParseRouterID(tt.in)
+		if err != nil || id.EUI != tt.want.EUI || id.Format != tt.want.Format {
+			t.Errorf("ParseRouterID(%v) got %+v, %v, want %+v", tt.in, id, err, tt.want)
+			continue
+		}
+		if id.String() != tt.text {
+			t.Errorf("%+v String got %q, want %q", id, id.String(), tt.text)
+		}
+
+		// Replies echo the identifier as the station sent it
+		got, _ := json.Marshal(id)
+		want, _ := json.Marshal(tt.in)
+		if string(got) != string(want) {
+			t.Errorf("%+v marshal got %s, want %s", id, got, want)
+		}
+	}
+
+	for _, in := range []interface{}{"", "xyz", "01-02-03", float64(-1), 1.5, true} {
+		if _, err := ParseRouterID(in); err == nil {
+			t.Errorf("ParseRouterID(%v) expected error", in)
+		}
+	}
+
+	// Integers stay numbers in json
+	b, err := json.Marshal(RouterID{EUI: 0x0102030405060708, Format: IntFormat})
+	if err != nil || string(b) != "72623859790382856" {
+		t.Errorf("marshal got %s, %v", b, err)
+	}
+}
+
+func TestGatewayPathID6(t *testing.T) {
+
+	rs := newRecordingServer()
+	s, ws, gw := connectStation(t, rs, "::1", "gps")
+	defer s.Close()
+	defer ws.Close()
+
+	if gw.EUI != 1 {
+		t.Errorf("gateway EUI got %x, want 1", gw.EUI)
+	}
+}
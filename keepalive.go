@@ -0,0 +1,101 @@
+package basicstation
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// DefaultPingInterval is the default interval between websocket pings
+	DefaultPingInterval = 30 * time.Second
+
+	// DefaultPongTimeout is the default time the station has to answer a
+	// ping before it is considered gone
+	DefaultPongTimeout = 10 * time.Second
+)
+
+// ErrPeerTimeout is returned by Run when the station stopped answering pings
+var ErrPeerTimeout = errors.New("station keepalive timeout")
+
+// pingInterval returns the ping interval, zero if keepalive is disabled
+func (gw *Gateway) pingInterval() time.Duration {
+	switch {
+	case gw.PingInterval < 0:
+		return 0
+	case gw.PingInterval == 0:
+		return DefaultPingInterval
+	}
+	return gw.PingInterval
+}
+
+// readTimeout returns how long the station may stay silent
+func (gw *Gateway) readTimeout() time.Duration {
+	timeout := gw.PongTimeout
+	if timeout <= 0 {
+		timeout = DefaultPongTimeout
+	}
+	return gw.pingInterval() + timeout
+}
+
+// extendReadDeadline pushes back the read deadline after station traffic
+func (gw *Gateway) extendReadDeadline() error {
+	if gw.pingInterval() == 0 {
+		return nil
+	}
+	return gw.conn.SetReadDeadline(time.Now().Add(gw.readTimeout()))
+}
+
+// startKeepalive arms the read deadline, installs the pong handler and pings
+// the station until stop is closed. A station that stays silent for longer
+// than the ping interval and the pong timeout fails the pending read.
+func (gw *Gateway) startKeepalive(stop <-chan struct{}, log Logger) {
+	interval := gw.pingInterval()
+	if interval == 0 {
+		return
+	}
+
+	gw.conn.SetPongHandler(func(string) error {
+		gw.stats.pong(time.Now())
+		return gw.extendReadDeadline()
+	})
+	gw.extendReadDeadline()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				// Control frames may be written concurrently with the writer
+				deadline := time.Now().Add(gw.writeTimeout())
+				if err := gw.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+					log.Debug(gw.EUI, "websocket ping failed", err)
+					continue
+				}
+				gw.stats.add(&gw.stats.pingsSent, 1)
+			}
+		}
+	}()
+}
+
+// peerTimedOut reports whether a read failed because the station went
+// silent, and if so closes the connection telling the station why
+func (gw *Gateway) peerTimedOut(err error, log Logger) bool {
+	var netErr net.Error
+	if gw.pingInterval() == 0 || !errors.As(err, &netErr) || !netErr.Timeout() {
+		return false
+	}
+
+	gw.stats.add(&gw.stats.peerTimeouts, 1)
+	log.Error(gw.EUI, ErrPeerTimeout, "no traffic from station, closing connection")
+
+	gw.sendClose(websocket.CloseGoingAway, ErrPeerTimeout.Error())
+
+	return true
+}
@@ -87,7 +87,7 @@ func (gw *MockGW) DoDiscovery() (err error) {
 
 	gw.Log.Debug().
 		Str("service", "discovery").
-		Str("Router", gw.DResp.Router).
+		Interface("Router", gw.DResp.Router).
 		Str("MUXS", gw.DResp.MUXS).
 		Str("URI", gw.DResp.URI).
 		Str("Error", gw.DResp.Error).
@@ -145,6 +145,9 @@ func (gw *MockGW) DoMuxsConnect() (err error) {
 		Msg("Sending version")
 
 	gw.Version.MsgType = "version"
+	if gw.Version.Protocol == 0 {
+		gw.Version.Protocol = MaxProtocolVersion
+	}
 	err = conn.WriteJSON(&gw.Version)
 	if err != nil {
 		gw.Log.Error().
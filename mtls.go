@@ -0,0 +1,89 @@
+package basicstation
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// NewTLSConfig returns a server TLS configuration requiring stations to
+// present a client certificate issued by a CA of clientCAFile, as stations
+// configured with tc.crt/tc.key or cups.crt/cups.key do
+func NewTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := LoadCertPool(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// LoadCertPool reads a file of PEM encoded CA certificates
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s: no PEM certificates", path)
+	}
+
+	return pool, nil
+}
+
+// CertificateEUI returns the gateway EUI of a client certificate, from its
+// common name or else its DNS subject alternative names. The EUI may be in
+// any router id notation and prefixed with "eui-".
+func CertificateEUI(cert *x509.Certificate) (uint64, error) {
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+
+	for _, name := range names {
+		if len(name) > 4 && strings.EqualFold(name[:4], "eui-") {
+			name = name[4:]
+		}
+		if id, err := ParseRouterID(name); err == nil {
+			return id.EUI, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no gateway EUI in certificate %q", cert.Subject)
+}
+
+// CertAuthenticator authenticates stations by their verified TLS client
+// certificate, the EUI of the certificate must be the one the station
+// connects as
+type CertAuthenticator struct{}
+
+// Authenticate checks the client certificate EUI
+func (CertAuthenticator) Authenticate(eui uint64, r *http.Request) (Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return Identity{}, fmt.Errorf("%w: no verified client certificate", ErrUnauthorized)
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+
+	certEUI, err := CertificateEUI(cert)
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %v", ErrForbidden, err)
+	}
+	if certEUI != eui {
+		return Identity{}, fmt.Errorf("%w: certificate is for %s", ErrForbidden, RouterID{EUI: certEUI}.String())
+	}
+
+	return Identity{EUI: eui, Name: cert.Subject.CommonName, Method: "mtls"}, nil
+}
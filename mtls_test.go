@@ -0,0 +1,207 @@
+package basicstation
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// testCA issues certificates for the mutual TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	return &testCA{cert: cert, key: key, der: der}
+}
+
+// issue returns a certificate and key signed by the CA
+func (ca *testCA) issue(t *testing.T, cn string, dnsNames []string, server bool) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writePEM writes a certificate and its key to dir
+func writePEM(t *testing.T, dir, name string, cert tls.Certificate) (certFile, keyFile string) {
+	t.Helper()
+
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	return certFile, keyFile
+}
+
+func TestCertificateEUI(t *testing.T) {
+
+	tcs := []struct {
+		cn       string
+		dnsNames []string
+		eui      uint64
+		ok       bool
+	}{
+		{"0000000000000001", nil, 1, true},
+		{"eui-00-00-00-00-00-00-00-02", nil, 2, true},
+		{"gateway rooftop", []string{"gw.example.com", "eui-::3"}, 3, true},
+		{"gateway rooftop", []string{"gw.example.com"}, 0, false},
+	}
+
+	for _, tt := range tcs {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: tt.cn}, DNSNames: tt.dnsNames}
+		eui, err := CertificateEUI(cert)
+		if (err == nil) != tt.ok || eui != tt.eui {
+			t.Errorf("%q %v got %x, %v, want %x", tt.cn, tt.dnsNames, eui, err, tt.eui)
+		}
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := filepath.Join(dir, "ca.crt")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.der}), 0600)
+
+	certFile, keyFile := writePEM(t, dir, "server", ca.issue(t, "muxs", nil, true))
+	conf, err := NewTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs := newRecordingServer()
+	rs.conf = newRouterConf()
+	rs.discovery = DiscoveryResponse{URI: "wss://muxs/0000000000000001"}
+	env := &Environment{Server: rs}
+
+	router := mux.NewRouter()
+	router.Handle(DiscoveryURL, DiscoveryHandler{Env: env, Auth: CertAuthenticator{}})
+	router.Handle("/{eui}", GatewayHandler{Env: env, Auth: CertAuthenticator{}})
+
+	s := httptest.NewUnstartedServer(router)
+	s.TLS = conf
+	s.StartTLS()
+	defer s.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	dialer := websocket.Dialer{
+		TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: []tls.Certificate{ca.issue(t, "0000000000000001", nil, false)},
+		},
+	}
+	base := "wss" + strings.TrimPrefix(s.URL, "https")
+
+	// Muxs connection as the certificate EUI
+	ws, _, err := dialer.Dial(base+"/::1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendMessage(t, ws, map[string]interface{}{"msgtype": "version", "protocol": 2})
+	var rc RouterConf
+	receiveWSMessage(t, ws, &rc)
+	if gw := <-rs.gws; gw.Identity != (Identity{EUI: 1, Name: "0000000000000001", Method: "mtls"}) {
+		t.Errorf("identity got %+v", gw.Identity)
+	}
+	ws.Close()
+
+	// Muxs connection as another gateway
+	_, resp, err := dialer.Dial(base+"/0000000000000002", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("dial as another gateway got %v, want 403", err)
+	}
+
+	// Discovery of the certificate EUI and of another gateway
+	for router, wantErr := range map[string]string{"::1": "", "::2": "forbidden"} {
+		ws, _, err := dialer.Dial(base+DiscoveryURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sendMessage(t, ws, map[string]interface{}{"router": router})
+
+		var reply DiscoveryResponse
+		receiveWSMessage(t, ws, &reply)
+		if reply.Error != wantErr {
+			t.Errorf("discovery of %s got %+v, want error %q", router, reply, wantErr)
+		}
+		ws.Close()
+	}
+
+	// No client certificate fails the handshake
+	dialer.TLSClientConfig.Certificates = nil
+	if _, _, err := dialer.Dial(base+"/::1", nil); err == nil {
+		t.Errorf("dial without client certificate succeeded")
+	}
+}
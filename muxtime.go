@@ -0,0 +1,114 @@
+package basicstation
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rttSmoothing is the weight of a new sample in the smoothed round trip time
+const rttSmoothing = 8
+
+// RoundTrip summarises the round trip times measured with MuxTime/RefTime
+type RoundTrip struct {
+	Last     time.Duration
+	Smoothed time.Duration
+	Min      time.Duration
+	Max      time.Duration
+	Samples  uint
+}
+
+// roundTrip is the rolling round trip estimate of a gateway session
+type roundTrip struct {
+	sync.Mutex
+	rt RoundTrip
+}
+
+func (r *roundTrip) add(sample time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.rt.Samples == 0 {
+		r.rt.Smoothed = sample
+		r.rt.Min = sample
+		r.rt.Max = sample
+	} else {
+		r.rt.Smoothed += (sample - r.rt.Smoothed) / rttSmoothing
+		if sample < r.rt.Min {
+			r.rt.Min = sample
+		}
+		if sample > r.rt.Max {
+			r.rt.Max = sample
+		}
+	}
+	r.rt.Last = sample
+	r.rt.Samples++
+}
+
+// RoundTrip returns the round trip times between the LNS and the station
+func (gw *Gateway) RoundTrip() RoundTrip {
+	gw.roundTrip.Lock()
+	defer gw.roundTrip.Unlock()
+
+	return gw.roundTrip.rt
+}
+
+// muxTime returns a wall clock time as MuxTime, UTC seconds since the epoch
+func muxTime(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+// refTime returns the RefTime of an upstream message, zero if none
+func refTime(msg interface{}) float64 {
+	switch m := msg.(type) {
+	case Uplink:
+		return m.RefTime
+	case JoinRequest:
+		return m.RefTime
+	case ProprietaryFrame:
+		return m.RefTime
+	case DnTxed:
+		return m.RefTime
+	case TimeSync:
+		return m.RefTime
+	}
+	return 0
+}
+
+// measureRoundTrip adds the round trip sample of a RefTime received at now.
+// The station sets RefTime to the last MuxTime plus the time elapsed since
+// that message was received, the difference to now is the round trip time.
+func (gw *Gateway) measureRoundTrip(ref float64, now time.Time) {
+	if ref == 0 {
+		return
+	}
+
+	sample := time.Duration((muxTime(now) - ref) * float64(time.Second))
+	if sample < 0 {
+		return
+	}
+
+	gw.roundTrip.add(sample)
+}
+
+// stampMuxTime adds a MuxTime field to a json encoded object unless it
+// already has one
+func stampMuxTime(b []byte, t time.Time) []byte {
+	b = bytes.TrimSpace(b)
+	if len(b) < 2 || b[0] != '{' || bytes.Contains(b, []byte(`"MuxTime":`)) {
+		return b
+	}
+
+	field := `"MuxTime":` + strconv.FormatFloat(muxTime(t), 'f', 6, 64)
+
+	out := make([]byte, 0, len(b)+len(field)+1)
+	out = append(out, '{')
+	out = append(out, field...)
+	if rest := bytes.TrimSpace(b[1:]); len(rest) > 0 && rest[0] != '}' {
+		out = append(out, ',')
+	}
+	out = append(out, b[1:]...)
+
+	return out
+}
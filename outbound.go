@@ -0,0 +1,171 @@
+package basicstation
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// DefaultOutboundQueueSize is the default capacity of each of the
+	// downlink and housekeeping outbound queues of a gateway
+	DefaultOutboundQueueSize = 64
+
+	// DefaultWriteTimeout is the default write deadline of a message
+	DefaultWriteTimeout = 10 * time.Second
+)
+
+var (
+	// ErrOutboundQueueFull is returned when a message is written faster
+	// than the station connection drains the outbound queue
+	ErrOutboundQueueFull = errors.New("outbound queue full")
+
+	// ErrConnectionClosed is returned when writing to a gateway whose
+	// session has ended
+	ErrConnectionClosed = errors.New("connection closed")
+)
+
+// outboundMsg is a websocket message waiting to be written
+type outboundMsg struct {
+	mt      int
+	data    []byte
+	msgType string
+
+	// downlinks is the number of downlink transmissions in the message
+	downlinks int
+
+	// urgent messages are queued with the downlinks
+	urgent bool
+}
+
+// outboundQueue holds the messages of a gateway until its writer sends
+// them. Downlinks are time critical and go ahead of housekeeping messages.
+type outboundQueue struct {
+	downlink     chan outboundMsg
+	housekeeping chan outboundMsg
+	closed       chan struct{}
+}
+
+func newOutboundQueue(size int) *outboundQueue {
+	if size <= 0 {
+		size = DefaultOutboundQueueSize
+	}
+
+	return &outboundQueue{
+		downlink:     make(chan outboundMsg, size),
+		housekeeping: make(chan outboundMsg, size),
+		closed:       make(chan struct{}),
+	}
+}
+
+func (q *outboundQueue) put(m outboundMsg) error {
+	select {
+	case <-q.closed:
+		return ErrConnectionClosed
+	default:
+	}
+
+	ch := q.housekeeping
+	if m.downlinks > 0 || m.urgent {
+		ch = q.downlink
+	}
+
+	select {
+	case ch <- m:
+		return nil
+	default:
+		return ErrOutboundQueueFull
+	}
+}
+
+// downlinkCount returns the number of downlink transmissions in a message
+func downlinkCount(msg interface{}) int {
+	switch m := msg.(type) {
+	case Downlink, *Downlink:
+		return 1
+	case DnSched:
+		return len(m.Schedule)
+	case *DnSched:
+		return len(m.Schedule)
+	}
+	return 0
+}
+
+// isUrgent reports whether a message is timed by the station. A timesync
+// reply held up behind queued messages would skew the offset the station
+// computes from its round trip.
+func isUrgent(msg interface{}) bool {
+	switch m := msg.(type) {
+	case TimeSync:
+		return m.TxTime != 0
+	case *TimeSync:
+		return m.TxTime != 0
+	}
+	return false
+}
+
+// outbound returns the gateway outbound queue, created on first use so
+// messages can be queued before Run starts the writer
+func (gw *Gateway) outbound() *outboundQueue {
+	gw.outOnce.Do(func() {
+		gw.out = newOutboundQueue(gw.OutboundQueueSize)
+	})
+	return gw.out
+}
+
+// runWriter is the single writer of the gateway websocket, it sends the
+// queued messages until stop is closed
+func (gw *Gateway) runWriter(stop <-chan struct{}, log Logger) {
+	q := gw.outbound()
+	defer close(q.closed)
+
+	for {
+		var m outboundMsg
+
+		// Downlinks first
+		select {
+		case m = <-q.downlink:
+		default:
+			select {
+			case m = <-q.downlink:
+			case m = <-q.housekeeping:
+			case <-stop:
+				return
+			}
+		}
+
+		if err := gw.write(m); err != nil {
+			// A failed write leaves the websocket unusable, closing it
+			// ends the reader and so the session
+			log.Error(gw.EUI, err, "websocket write failed")
+			gw.conn.Close()
+			return
+		}
+	}
+}
+
+// writeTimeout returns the write deadline of a message
+func (gw *Gateway) writeTimeout() time.Duration {
+	if gw.WriteTimeout <= 0 {
+		return DefaultWriteTimeout
+	}
+	return gw.WriteTimeout
+}
+
+// write sends a message with a write deadline, text messages are stamped
+// with the MuxTime the station echoes back as RefTime
+func (gw *Gateway) write(m outboundMsg) error {
+	now := time.Now()
+	gw.conn.SetWriteDeadline(now.Add(gw.writeTimeout()))
+
+	data := m.data
+	if m.mt == websocket.TextMessage {
+		data = stampMuxTime(data, now)
+	}
+
+	err := gw.conn.WriteMessage(m.mt, data)
+	gw.stats.written(m, len(data), err)
+
+	return err
+}
@@ -0,0 +1,298 @@
+package basicstation
+
+import (
+	"fmt"
+	"strings"
+)
+
+// region holds the LoRaWAN regional parameters and default channel plan
+type region struct {
+	name string
+
+	// rx1DR maps an uplink datarate and RX1 DR offset to the RX1 datarate
+	rx1DR func(dr, offset int) (int, error)
+
+	// rx1Freq maps an uplink frequency to the RX1 frequency
+	rx1Freq func(freq int) (int, error)
+
+	rx2DR   int
+	rx2Freq int
+
+	// drs is the router_config DR table, [SF, BW in kHz, downlink only]
+	drs       [][]int
+	freqRange []uint
+	maxEIRP   int
+
+	// subBands is the number of 8 channel sub-bands of the region, zero
+	// for regions with a single fixed channel plan
+	subBands int
+
+	// plan returns the channels of a board serving a 1-based sub-band
+	plan func(subBand int) boardPlan
+}
+
+// UnknownRegion error
+type UnknownRegion struct {
+	name string
+}
+
+// Error satisifies error interface
+func (u UnknownRegion) Error() string {
+	return fmt.Sprintf("unknown region: %s", u.name)
+}
+
+// regions maps the Basic Station region names, and their common aliases,
+// to the regional parameters
+var regions = map[string]*region{}
+
+func init() {
+	for _, r := range []struct {
+		names []string
+		reg   region
+	}{
+		{[]string{"EU863", "EU868"}, region{
+			rx1DR: offsetDR(7), rx1Freq: sameFreq, rx2DR: 0, rx2Freq: 869525000,
+			drs: euDRs, freqRange: []uint{863000000, 870000000}, maxEIRP: 16,
+			plan: eu868Plan}},
+		{[]string{"US902", "US915"}, region{
+			rx1DR: tableDR(us915RX1DR), rx1Freq: us915RX1Freq, rx2DR: 8, rx2Freq: 923300000,
+			drs: us915DRs, freqRange: []uint{902000000, 928000000}, maxEIRP: 30,
+			subBands: 8, plan: subBandPlan(902300000, 903000000)}},
+		{[]string{"AU915"}, region{
+			rx1DR: tableDR(au915RX1DR), rx1Freq: au915RX1Freq, rx2DR: 8, rx2Freq: 923300000,
+			drs: au915DRs, freqRange: []uint{915000000, 928000000}, maxEIRP: 30,
+			subBands: 8, plan: subBandPlan(915200000, 915900000)}},
+		{[]string{"AS923", "AS923-1", "AS923_1"}, region{
+			rx1DR: as923RX1DR, rx1Freq: sameFreq, rx2DR: 2, rx2Freq: 923200000,
+			drs: euDRs, freqRange: []uint{915000000, 928000000}, maxEIRP: 16,
+			plan: as923Plan(0)}},
+		{[]string{"AS923-2", "AS923_2"}, region{
+			rx1DR: as923RX1DR, rx1Freq: sameFreq, rx2DR: 2, rx2Freq: 921400000,
+			drs: euDRs, freqRange: []uint{915000000, 928000000}, maxEIRP: 16,
+			plan: as923Plan(-1800000)}},
+		{[]string{"AS923-3", "AS923_3"}, region{
+			rx1DR: as923RX1DR, rx1Freq: sameFreq, rx2DR: 2, rx2Freq: 916600000,
+			drs: euDRs, freqRange: []uint{915000000, 928000000}, maxEIRP: 16,
+			plan: as923Plan(-6600000)}},
+		{[]string{"AS923-4", "AS923_4"}, region{
+			rx1DR: as923RX1DR, rx1Freq: sameFreq, rx2DR: 2, rx2Freq: 917300000,
+			drs: euDRs, freqRange: []uint{915000000, 928000000}, maxEIRP: 16,
+			plan: as923Plan(-5900000)}},
+		{[]string{"KR920"}, region{
+			rx1DR: offsetDR(5), rx1Freq: sameFreq, rx2DR: 0, rx2Freq: 921900000,
+			drs: loraDRs, freqRange: []uint{920900000, 923300000}, maxEIRP: 14,
+			plan: fixedPlan(922100000, 922300000, 922500000, 922700000, 922900000, 923100000, 923300000, 921900000)}},
+		{[]string{"IN865"}, region{
+			rx1DR: as923RX1DR, rx1Freq: sameFreq, rx2DR: 2, rx2Freq: 866550000,
+			drs: in865DRs, freqRange: []uint{865000000, 867000000}, maxEIRP: 30,
+			plan: fixedPlan(865062500, 865402500, 865985000, 866185000, 866385000, 866585000, 866785000)}},
+		{[]string{"CN470"}, region{
+			rx1DR: offsetDR(5), rx1Freq: cn470RX1Freq, rx2DR: 0, rx2Freq: 505300000,
+			drs: loraDRs, freqRange: []uint{470000000, 510000000}, maxEIRP: 19,
+			subBands: 12, plan: subBandPlan(470300000, 0)}},
+	} {
+		reg := r.reg
+		reg.name = r.names[0]
+		for _, name := range r.names {
+			regions[name] = &reg
+		}
+	}
+}
+
+// lookupRegion returns the regional parameters for a router_config region name
+func lookupRegion(name string) (*region, error) {
+	r, ok := regions[strings.ToUpper(name)]
+	if !ok {
+		return nil, UnknownRegion{name: name}
+	}
+	return r, nil
+}
+
+func sameFreq(freq int) (int, error) {
+	return freq, nil
+}
+
+// offsetDR returns a RX1 datarate mapping subtracting the offset from the
+// uplink datarate, with max being the highest uplink datarate of the region
+func offsetDR(max int) func(dr, offset int) (int, error) {
+	return func(dr, offset int) (int, error) {
+		if dr < 0 || dr > max || offset < 0 || offset > 5 {
+			return 0, fmt.Errorf("invalid uplink DR%d with RX1 DR offset %d", dr, offset)
+		}
+		dr -= offset
+		if dr < 0 {
+			dr = 0
+		}
+		return dr, nil
+	}
+}
+
+// as923RX1DR implements the RX1 datarate mapping of AS923 and IN865 where
+// offsets 6 and 7 raise the downlink datarate
+func as923RX1DR(dr, offset int) (int, error) {
+	if dr < 0 || dr > 7 || offset < 0 || offset > 7 {
+		return 0, fmt.Errorf("invalid uplink DR%d with RX1 DR offset %d", dr, offset)
+	}
+	eff := offset
+	if offset > 5 {
+		eff = 5 - offset
+	}
+	dr -= eff
+	switch {
+	case dr < 0:
+		dr = 0
+	case dr > 5:
+		dr = 5
+	}
+	return dr, nil
+}
+
+var us915RX1DR = [][]int{
+	{10, 9, 8, 8},
+	{11, 10, 9, 8},
+	{12, 11, 10, 9},
+	{13, 12, 11, 10},
+	{13, 13, 12, 11},
+}
+
+var au915RX1DR = [][]int{
+	{8, 8, 8, 8, 8, 8},
+	{9, 8, 8, 8, 8, 8},
+	{10, 9, 8, 8, 8, 8},
+	{11, 10, 9, 8, 8, 8},
+	{12, 11, 10, 9, 8, 8},
+	{13, 12, 11, 10, 9, 8},
+	{13, 13, 12, 11, 10, 9},
+}
+
+// tableDR returns a RX1 datarate mapping looked up by [uplink DR][offset]
+func tableDR(table [][]int) func(dr, offset int) (int, error) {
+	return func(dr, offset int) (int, error) {
+		if dr < 0 || dr >= len(table) || offset < 0 || offset >= len(table[dr]) {
+			return 0, fmt.Errorf("invalid uplink DR%d with RX1 DR offset %d", dr, offset)
+		}
+		return table[dr][offset], nil
+	}
+}
+
+// us915RX1Freq maps the uplink channel to one of the 8 downlink channels
+func us915RX1Freq(freq int) (int, error) {
+	var ch int
+	switch {
+	case freq >= 902300000 && freq <= 914900000 && (freq-902300000)%200000 == 0:
+		ch = (freq - 902300000) / 200000
+	case freq >= 903000000 && freq <= 914200000 && (freq-903000000)%1600000 == 0:
+		ch = 64 + (freq-903000000)/1600000
+	default:
+		return 0, fmt.Errorf("frequency %d is not a US915 uplink channel", freq)
+	}
+	return 923300000 + (ch%8)*600000, nil
+}
+
+// au915RX1Freq maps the uplink channel to one of the 8 downlink channels
+func au915RX1Freq(freq int) (int, error) {
+	var ch int
+	switch {
+	case freq >= 915200000 && freq <= 927800000 && (freq-915200000)%200000 == 0:
+		ch = (freq - 915200000) / 200000
+	case freq >= 915900000 && freq <= 927100000 && (freq-915900000)%1600000 == 0:
+		ch = 64 + (freq-915900000)/1600000
+	default:
+		return 0, fmt.Errorf("frequency %d is not an AU915 uplink channel", freq)
+	}
+	return 923300000 + (ch%8)*600000, nil
+}
+
+// cn470RX1Freq maps the uplink channel to one of the 48 downlink channels
+func cn470RX1Freq(freq int) (int, error) {
+	if freq < 470300000 || freq > 489300000 || (freq-470300000)%200000 != 0 {
+		return 0, fmt.Errorf("frequency %d is not a CN470 uplink channel", freq)
+	}
+	ch := (freq - 470300000) / 200000
+	return 500300000 + (ch%48)*200000, nil
+}
+
+// undefinedDR marks an unused entry of a router_config DR table
+var undefinedDR = []int{-1, 0, 0}
+
+// loraDRs is the DR table of regions with DR0-5 only, SF12 to SF7 at 125kHz
+var loraDRs = [][]int{
+	{12, 125, 0}, {11, 125, 0}, {10, 125, 0}, {9, 125, 0},
+	{8, 125, 0}, {7, 125, 0}, undefinedDR, undefinedDR,
+	undefinedDR, undefinedDR, undefinedDR, undefinedDR,
+	undefinedDR, undefinedDR, undefinedDR, undefinedDR,
+}
+
+// euDRs adds SF7 at 250kHz and FSK, an SF of 0, to loraDRs
+var euDRs = [][]int{
+	{12, 125, 0}, {11, 125, 0}, {10, 125, 0}, {9, 125, 0},
+	{8, 125, 0}, {7, 125, 0}, {7, 250, 0}, {0, 0, 0},
+	undefinedDR, undefinedDR, undefinedDR, undefinedDR,
+	undefinedDR, undefinedDR, undefinedDR, undefinedDR,
+}
+
+var in865DRs = [][]int{
+	{12, 125, 0}, {11, 125, 0}, {10, 125, 0}, {9, 125, 0},
+	{8, 125, 0}, {7, 125, 0}, undefinedDR, {0, 0, 0},
+	undefinedDR, undefinedDR, undefinedDR, undefinedDR,
+	undefinedDR, undefinedDR, undefinedDR, undefinedDR,
+}
+
+var us915DRs = [][]int{
+	{10, 125, 0}, {9, 125, 0}, {8, 125, 0}, {7, 125, 0},
+	{8, 500, 0}, undefinedDR, undefinedDR, undefinedDR,
+	{12, 500, 1}, {11, 500, 1}, {10, 500, 1}, {9, 500, 1},
+	{8, 500, 1}, {7, 500, 1}, undefinedDR, undefinedDR,
+}
+
+var au915DRs = [][]int{
+	{12, 125, 0}, {11, 125, 0}, {10, 125, 0}, {9, 125, 0},
+	{8, 125, 0}, {7, 125, 0}, {8, 500, 0}, undefinedDR,
+	{12, 500, 1}, {11, 500, 1}, {10, 500, 1}, {9, 500, 1},
+	{8, 500, 1}, {7, 500, 1}, undefinedDR, undefinedDR,
+}
+
+func eu868Plan(int) boardPlan {
+	return boardPlan{
+		multiSF: []int{868100000, 868300000, 868500000, 867100000, 867300000, 867500000, 867700000, 867900000},
+		std:     &planChannel{freq: 868300000, bw: 250000, sf: 7},
+		fsk:     &planChannel{freq: 868800000, bw: 125000, datarate: 50000},
+	}
+}
+
+// as923Plan returns the AS923 plan of a group shifted by offset Hz
+func as923Plan(offset int) func(int) boardPlan {
+	return func(int) boardPlan {
+		plan := boardPlan{
+			std: &planChannel{freq: 922100000 + offset, bw: 250000, sf: 7},
+			fsk: &planChannel{freq: 921800000 + offset, bw: 125000, datarate: 50000},
+		}
+		for _, f := range []int{923200000, 923400000, 922200000, 922400000, 922600000, 922800000, 923000000, 922000000} {
+			plan.multiSF = append(plan.multiSF, f+offset)
+		}
+		return plan
+	}
+}
+
+// fixedPlan returns a plan of 125kHz channels only
+func fixedPlan(freqs ...int) func(int) boardPlan {
+	return func(int) boardPlan {
+		return boardPlan{multiSF: freqs}
+	}
+}
+
+// subBandPlan returns the plan of regions with 125kHz channels every 200kHz
+// from base125, grouped by 8 in sub-bands. base500 is the first 500kHz
+// channel, one per sub-band spaced 1.6MHz, zero if the region has none.
+func subBandPlan(base125, base500 int) func(int) boardPlan {
+	return func(subBand int) boardPlan {
+		var plan boardPlan
+		for i := 0; i < 8; i++ {
+			plan.multiSF = append(plan.multiSF, base125+((subBand-1)*8+i)*200000)
+		}
+		if base500 != 0 {
+			plan.std = &planChannel{freq: base500 + (subBand-1)*1600000, bw: 500000, sf: 8}
+		}
+		return plan
+	}
+}
@@ -0,0 +1,196 @@
+package basicstation
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// DuplicatePolicy decides what happens when a gateway connects while a
+// session with the same EUI is registered
+type DuplicatePolicy int
+
+const (
+	// DuplicateKickOld closes the registered session in favour of the new one
+	DuplicateKickOld DuplicatePolicy = iota
+	// DuplicateRejectNew refuses the new session
+	DuplicateRejectNew
+	// DuplicateAllowBoth keeps both sessions, Get returns the newest
+	DuplicateAllowBoth
+)
+
+// DuplicateGateway error
+type DuplicateGateway struct {
+	eui uint64
+}
+
+// Error satisifies error interface
+func (d DuplicateGateway) Error() string {
+	return fmt.Sprintf("gateway %016x is already connected", d.eui)
+}
+
+// Registry tracks the connected gateways by EUI. A GatewayHandler session
+// is registered once it sent the router configuration, so its Version and
+// Capabilities are settled and it accepts downlinks, and removed when it
+// ends.
+type Registry struct {
+	// Policy applies to a second session from the same EUI
+	Policy DuplicatePolicy
+
+	// OnConnect and OnDisconnect, if set, are called as sessions are added
+	// and removed. They must not block.
+	OnConnect    func(gw *Gateway)
+	OnDisconnect func(gw *Gateway)
+
+	mu  sync.RWMutex
+	gws map[uint64][]*Gateway
+}
+
+// NewRegistry returns an empty registry with the given duplicate policy
+func NewRegistry(policy DuplicatePolicy) *Registry {
+	return &Registry{Policy: policy}
+}
+
+// Get returns the session of a gateway, the newest one if there are several
+func (r *Registry) Get(eui uint64) (*Gateway, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	sessions := r.gws[eui]
+	if len(sessions) == 0 {
+		return nil, false
+	}
+
+	return sessions[len(sessions)-1], true
+}
+
+// List returns the registered sessions ordered by EUI
+func (r *Registry) List() []*Gateway {
+	var list []*Gateway
+
+	r.Range(func(gw *Gateway) bool {
+		list = append(list, gw)
+		return true
+	})
+
+	sort.SliceStable(list, func(i, j int) bool { return list[i].EUI < list[j].EUI })
+
+	return list
+}
+
+// Range calls f for every registered session until f returns false. The
+// registry may change while Range runs, f sees a snapshot.
+func (r *Registry) Range(f func(gw *Gateway) bool) {
+	r.mu.RLock()
+	var all []*Gateway
+	for _, sessions := range r.gws {
+		all = append(all, sessions...)
+	}
+	r.mu.RUnlock()
+
+	for _, gw := range all {
+		if !f(gw) {
+			return
+		}
+	}
+}
+
+// Len returns the number of registered sessions
+func (r *Registry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	n := 0
+	for _, sessions := range r.gws {
+		n += len(sessions)
+	}
+	return n
+}
+
+// add registers a session according to the duplicate policy, the returned
+// sessions were displaced and must be closed by the caller
+func (r *Registry) add(gw *Gateway) ([]*Gateway, error) {
+	r.mu.Lock()
+
+	if r.gws == nil {
+		r.gws = make(map[uint64][]*Gateway)
+	}
+
+	var kicked []*Gateway
+
+	existing := r.gws[gw.EUI]
+	if len(existing) > 0 {
+		switch r.Policy {
+		case DuplicateRejectNew:
+			r.mu.Unlock()
+			return nil, DuplicateGateway{eui: gw.EUI}
+		case DuplicateKickOld:
+			kicked = existing
+			existing = nil
+		}
+	}
+	r.gws[gw.EUI] = append(existing, gw)
+
+	r.mu.Unlock()
+
+	for _, old := range kicked {
+		r.disconnected(old)
+	}
+	if r.OnConnect != nil {
+		r.OnConnect(gw)
+	}
+
+	return kicked, nil
+}
+
+// register adds a session and closes the sessions it displaced, a rejected
+// duplicate is closed
+func (r *Registry) register(gw *Gateway, log Logger) error {
+	kicked, err := r.add(gw)
+	if err != nil {
+		log.Error(gw.EUI, err, "duplicate gateway connection rejected")
+		gw.sendClose(websocket.ClosePolicyViolation, "duplicate connection")
+		return err
+	}
+
+	for _, old := range kicked {
+		log.Debug(old.EUI, "closing session replaced by a new connection", nil)
+		old.Close(websocket.CloseGoingAway, "replaced by a new connection")
+	}
+
+	return nil
+}
+
+// remove unregisters a session, it is a no-op if the session was displaced
+func (r *Registry) remove(gw *Gateway) {
+	r.mu.Lock()
+
+	found := false
+	sessions := r.gws[gw.EUI]
+	for i, s := range sessions {
+		if s == gw {
+			sessions = append(sessions[:i:i], sessions[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if len(sessions) == 0 {
+		delete(r.gws, gw.EUI)
+	} else {
+		r.gws[gw.EUI] = sessions
+	}
+
+	r.mu.Unlock()
+
+	if found {
+		r.disconnected(gw)
+	}
+}
+
+func (r *Registry) disconnected(gw *Gateway) {
+	if r.OnDisconnect != nil {
+		r.OnDisconnect(gw)
+	}
+}
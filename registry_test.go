@@ -0,0 +1,200 @@
+package basicstation
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// newRegistryServer starts a station server tracking sessions in reg
+func newRegistryServer(rs *recordingServer, reg *Registry) *httptest.Server {
+	rs.conf = newRouterConf()
+
+	router := mux.NewRouter()
+	router.Handle("/{eui}", GatewayHandler{Env: &Environment{Server: rs, Registry: reg}})
+
+	return httptest.NewServer(router)
+}
+
+// dialStation connects a station and completes the version exchange
+func dialStation(t *testing.T, s *httptest.Server, eui string) *websocket.Conn {
+	t.Helper()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/"+eui, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sendMessage(t, ws, map[string]interface{}{"msgtype": "version", "protocol": 2})
+
+	var conf RouterConf
+	receiveWSMessage(t, ws, &conf)
+
+	return ws
+}
+
+// expectClose reads until the station connection is closed with code
+func expectClose(t *testing.T, ws *websocket.Conn, code int) {
+	t.Helper()
+
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		_, _, err := ws.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, code) {
+			t.Errorf("station read got %v, want close %d", err, code)
+		}
+		return
+	}
+}
+
+func TestRegistryKickOld(t *testing.T) {
+
+	events := make(chan string, 8)
+	reg := NewRegistry(DuplicateKickOld)
+	reg.OnConnect = func(gw *Gateway) { events <- "connect" }
+	reg.OnDisconnect = func(gw *Gateway) { events <- "disconnect" }
+
+	rs := newRecordingServer()
+	s := newRegistryServer(rs, reg)
+	defer s.Close()
+
+	ws1 := dialStation(t, s, "0000000000000001")
+	defer ws1.Close()
+	gw1 := <-rs.gws
+
+	if gw, ok := reg.Get(1); !ok || gw != gw1 {
+		t.Fatalf("registry get got %v, %v", gw, ok)
+	}
+
+	ws2 := dialStation(t, s, "0000000000000001")
+	defer ws2.Close()
+	gw2 := <-rs.gws
+
+	expectClose(t, ws1, websocket.CloseGoingAway)
+
+	if gw, ok := reg.Get(1); !ok || gw != gw2 {
+		t.Errorf("registry get after kick got %v, want the new session", gw)
+	}
+	if reg.Len() != 1 {
+		t.Errorf("registry has %d sessions, want 1", reg.Len())
+	}
+
+	ws2.Close()
+	<-rs.errs
+	<-rs.errs
+
+	want := []string{"connect", "disconnect", "connect", "disconnect"}
+	for i, w := range want {
+		select {
+		case e := <-events:
+			if e != w {
+				t.Errorf("event %d got %s, want %s", i, e, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d %s missing", i, w)
+		}
+	}
+
+	if _, ok := reg.Get(1); ok {
+		t.Errorf("disconnected gateway still registered")
+	}
+}
+
+func TestRegistryRejectNew(t *testing.T) {
+
+	reg := NewRegistry(DuplicateRejectNew)
+	rs := newRecordingServer()
+	s := newRegistryServer(rs, reg)
+	defer s.Close()
+
+	ws1 := dialStation(t, s, "0000000000000001")
+	defer ws1.Close()
+	gw1 := <-rs.gws
+
+	ws2 := dialStation(t, s, "0000000000000001")
+	defer ws2.Close()
+	<-rs.gws
+	expectClose(t, ws2, websocket.ClosePolicyViolation)
+
+	if gw, ok := reg.Get(1); !ok || gw != gw1 {
+		t.Errorf("registry get got %v, want the first session", gw)
+	}
+}
+
+func TestRegistryAllowBoth(t *testing.T) {
+
+	reg := NewRegistry(DuplicateAllowBoth)
+	rs := newRecordingServer()
+	s := newRegistryServer(rs, reg)
+	defer s.Close()
+
+	ws1 := dialStation(t, s, "0000000000000002")
+	defer ws1.Close()
+	<-rs.gws
+	ws2 := dialStation(t, s, "0000000000000002")
+	defer ws2.Close()
+	gw2 := <-rs.gws
+	ws3 := dialStation(t, s, "0000000000000001")
+	defer ws3.Close()
+	<-rs.gws
+
+	list := reg.List()
+	if len(list) != 3 || list[0].EUI != 1 || list[1].EUI != 2 || list[2].EUI != 2 {
+		t.Fatalf("registry list got %v", list)
+	}
+	if gw, _ := reg.Get(2); gw != gw2 {
+		t.Errorf("registry get got %v, want the newest session", gw)
+	}
+
+	n := 0
+	reg.Range(func(gw *Gateway) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Errorf("range visited %d sessions after stop, want 1", n)
+	}
+}
+
+func TestRegistryReadyBeforeConnect(t *testing.T) {
+
+	reg := NewRegistry(DuplicateKickOld)
+	reg.OnConnect = func(gw *Gateway) {
+		if !gw.Capabilities.Has(CapGPS) {
+			t.Error("registered before the version was read")
+		}
+		entry := NewScheduleEntry([]byte{0x01}, 3, 868100000, 1300000000000000, 0)
+		if err := gw.SendSchedule(entry); err != nil {
+			t.Error(err)
+		}
+	}
+
+	rs := newRecordingServer()
+	s := newRegistryServer(rs, reg)
+	defer s.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/0000000000000001", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	<-rs.gws
+
+	sendMessage(t, ws, map[string]interface{}{"msgtype": "version", "protocol": 2, "features": "gps"})
+
+	// The downlink sent on connect never overtakes router_config
+	for _, want := range []string{rs.conf.MessageType, DnSchedMsgName} {
+		var msg map[string]interface{}
+		receiveWSMessage(t, ws, &msg)
+		if msg["msgtype"] != want {
+			t.Errorf("station received %v, want %s", msg["msgtype"], want)
+		}
+	}
+}
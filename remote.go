@@ -0,0 +1,270 @@
+package basicstation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// RunCmdMsgName is the remote command message type field value
+	RunCmdMsgName = "runcmd"
+
+	// RemoteShellMsgName is the remote shell message type field value
+	RemoteShellMsgName = "rmtsh"
+
+	// maxRemoteShells is the number of sessions addressable by the one byte
+	// session index prefixing the binary frames
+	maxRemoteShells = 256
+
+	// remoteShellBacklog is the number of binary frames buffered per session
+	remoteShellBacklog = 256
+)
+
+// RunCmd message asks the station to run a command
+type RunCmd struct {
+	MsgType   string   `json:"msgtype"`
+	Command   string   `json:"command"`
+	Arguments []string `json:"arguments"`
+}
+
+// RunCommand asks the station to run a command, for example to restart it,
+// upload its logs or run a diagnostic. The station does not report the
+// outcome of the command.
+func (gw *Gateway) RunCommand(ctx context.Context, command string, args []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if command == "" {
+		return errors.New("empty command")
+	}
+
+	if err := gw.requires(CapRemoteShell); err != nil {
+		return err
+	}
+
+	if args == nil {
+		args = []string{}
+	}
+
+	return gw.WriteJSON(&RunCmd{
+		MsgType:   RunCmdMsgName,
+		Command:   command,
+		Arguments: args,
+	})
+}
+
+// RemoteShellCtrl message starts or stops a remote shell session, or, with
+// neither set, asks the station for a RemoteShellStatus
+type RemoteShellCtrl struct {
+	MsgType string `json:"msgtype"`
+	User    string `json:"user,omitempty"`
+	Term    string `json:"term,omitempty"`
+	Start   *int   `json:"start,omitempty"`
+	Stop    *int   `json:"stop,omitempty"`
+}
+
+// RemoteShellSession is the station side state of a remote shell session
+type RemoteShellSession struct {
+	User    string `json:"user"`
+	Started bool   `json:"started"`
+	Age     int    `json:"age"`
+	PID     int    `json:"pid"`
+}
+
+// RemoteShellStatus message reports the remote shell sessions of the station
+type RemoteShellStatus struct {
+	MsgType  string               `json:"msgtype"`
+	Sessions []RemoteShellSession `json:"rmtsh" mapstructure:"rmtsh"`
+}
+
+// RemoteShell is a remote shell session on the station. Data is carried by
+// websocket binary frames prefixed with the session index.
+type RemoteShell struct {
+	gw      *Gateway
+	session int
+	inbound chan []byte
+	pending []byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// remoteShells demultiplexes binary frames to the remote shell sessions
+type remoteShells struct {
+	sync.Mutex
+	sessions map[int]*RemoteShell
+}
+
+// open allocates the lowest free session index
+func (rs *remoteShells) open(gw *Gateway) (*RemoteShell, error) {
+	rs.Lock()
+	defer rs.Unlock()
+
+	if rs.sessions == nil {
+		rs.sessions = make(map[int]*RemoteShell)
+	}
+
+	for i := 0; i < maxRemoteShells; i++ {
+		if _, ok := rs.sessions[i]; ok {
+			continue
+		}
+		sh := &RemoteShell{
+			gw:      gw,
+			session: i,
+			inbound: make(chan []byte, remoteShellBacklog),
+			closed:  make(chan struct{}),
+		}
+		rs.sessions[i] = sh
+		return sh, nil
+	}
+
+	return nil, errors.New("no free remote shell session")
+}
+
+func (rs *remoteShells) remove(session int) {
+	rs.Lock()
+	defer rs.Unlock()
+
+	delete(rs.sessions, session)
+}
+
+// deliver hands a binary frame to its session. Frames are dropped rather
+// than blocking the gateway reader when the session is not read.
+func (rs *remoteShells) deliver(frame []byte) error {
+	if len(frame) == 0 {
+		return errors.New("empty remote shell frame")
+	}
+
+	rs.Lock()
+	sh, ok := rs.sessions[int(frame[0])]
+	rs.Unlock()
+
+	if !ok {
+		return fmt.Errorf("remote shell data for unknown session %d", frame[0])
+	}
+
+	select {
+	case sh.inbound <- frame[1:]:
+		return nil
+	case <-sh.closed:
+		return nil
+	default:
+		return fmt.Errorf("remote shell session %d backlog full, data dropped", frame[0])
+	}
+}
+
+// closeAll ends every session, readers get io.EOF
+func (rs *remoteShells) closeAll() {
+	rs.Lock()
+	sessions := rs.sessions
+	rs.sessions = nil
+	rs.Unlock()
+
+	for _, sh := range sessions {
+		sh.closeOnce.Do(func() { close(sh.closed) })
+	}
+}
+
+// StartRemoteShell starts a remote shell session on the station as user
+// with the given terminal type
+func (gw *Gateway) StartRemoteShell(user, term string) (*RemoteShell, error) {
+	if err := gw.requires(CapRemoteShell); err != nil {
+		return nil, err
+	}
+
+	sh, err := gw.shells.open(gw)
+	if err != nil {
+		return nil, err
+	}
+
+	err = gw.WriteJSON(&RemoteShellCtrl{
+		MsgType: RemoteShellMsgName,
+		User:    user,
+		Term:    term,
+		Start:   &sh.session,
+	})
+	if err != nil {
+		gw.shells.remove(sh.session)
+		return nil, err
+	}
+
+	return sh, nil
+}
+
+// RemoteShellStatus asks the station to report its remote shell sessions,
+// the RemoteShellStatus answer is passed to the handler
+func (gw *Gateway) RemoteShellStatus() error {
+	if err := gw.requires(CapRemoteShell); err != nil {
+		return err
+	}
+
+	return gw.WriteJSON(&RemoteShellCtrl{MsgType: RemoteShellMsgName})
+}
+
+// Session returns the session index
+func (sh *RemoteShell) Session() int {
+	return sh.session
+}
+
+// Read reads shell output, io.EOF is returned once the session is closed
+// and all received output was read
+func (sh *RemoteShell) Read(p []byte) (int, error) {
+	for len(sh.pending) == 0 {
+		select {
+		case data := <-sh.inbound:
+			sh.pending = data
+		case <-sh.closed:
+			select {
+			case data := <-sh.inbound:
+				sh.pending = data
+			default:
+				return 0, io.EOF
+			}
+		}
+	}
+
+	n := copy(p, sh.pending)
+	sh.pending = sh.pending[n:]
+
+	return n, nil
+}
+
+// Write sends shell input
+func (sh *RemoteShell) Write(p []byte) (int, error) {
+	select {
+	case <-sh.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	frame := make([]byte, 0, len(p)+1)
+	frame = append(frame, byte(sh.session))
+	frame = append(frame, p...)
+
+	if err := sh.gw.writeBinary(frame); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Close stops the session on the station
+func (sh *RemoteShell) Close() error {
+	var err error
+
+	sh.closeOnce.Do(func() {
+		close(sh.closed)
+		sh.gw.shells.remove(sh.session)
+
+		err = sh.gw.WriteJSON(&RemoteShellCtrl{
+			MsgType: RemoteShellMsgName,
+			Stop:    &sh.session,
+		})
+	})
+
+	return err
+}
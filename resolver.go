@@ -0,0 +1,142 @@
+package basicstation
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// DefaultMuxsPath is the muxs path template of DiscoveryResolver, it is the
+// path GatewayHandler is expected to be mounted on
+const DefaultMuxsPath = "/{eui}"
+
+// DiscoveryResolver builds discovery responses pointing stations back at the
+// host they discovered through. It can serve as Server.GetDiscoveryResponse.
+type DiscoveryResolver struct {
+	// Path is the muxs path template, {eui} is replaced by the station EUI.
+	// DefaultMuxsPath if empty.
+	Path string
+
+	// Host replaces the host of the discovery request if set
+	Host string
+
+	// MUXS identifies this instance in responses, if empty it is an ID6
+	// derived from the hostname so it is stable across restarts
+	MUXS string
+
+	mu        sync.RWMutex
+	overrides map[uint64]DiscoveryResponse
+
+	muxsOnce sync.Once
+	muxs     string
+}
+
+// NewDiscoveryResolver returns a resolver using the given path template
+func NewDiscoveryResolver(path string) *DiscoveryResolver {
+	return &DiscoveryResolver{Path: path}
+}
+
+// SetOverride hands out resp to the station instead of the computed
+// response. Empty fields of resp keep their computed value.
+func (dr *DiscoveryResolver) SetOverride(eui uint64, resp DiscoveryResponse) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	if dr.overrides == nil {
+		dr.overrides = make(map[uint64]DiscoveryResponse)
+	}
+	dr.overrides[eui] = resp
+}
+
+// RemoveOverride removes the override of a station
+func (dr *DiscoveryResolver) RemoveOverride(eui uint64) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	delete(dr.overrides, eui)
+}
+
+// GetDiscoveryResponse returns the muxs URI for the station. The scheme is
+// wss if the request came over TLS and the host is the request host, both
+// as reported by X-Forwarded-Proto and X-Forwarded-Host behind a proxy.
+func (dr *DiscoveryResolver) GetDiscoveryResponse(eui uint64, r *http.Request) (DiscoveryResponse, error) {
+	scheme := "ws"
+	if r.TLS != nil {
+		scheme = "wss"
+	}
+	switch forwardedValue(r, "X-Forwarded-Proto") {
+	case "https", "wss":
+		scheme = "wss"
+	case "http", "ws":
+		scheme = "ws"
+	}
+
+	host := r.Host
+	if fh := forwardedValue(r, "X-Forwarded-Host"); fh != "" {
+		host = fh
+	}
+	if dr.Host != "" {
+		host = dr.Host
+	}
+
+	path := dr.Path
+	if path == "" {
+		path = DefaultMuxsPath
+	}
+	path = strings.Replace(path, "{eui}", RouterID{EUI: eui, Format: HexFormat}.String(), -1)
+
+	resp := DiscoveryResponse{
+		URI:  scheme + "://" + host + path,
+		MUXS: dr.instanceID(),
+	}
+
+	dr.mu.RLock()
+	override, ok := dr.overrides[eui]
+	dr.mu.RUnlock()
+
+	if ok {
+		if override.URI != "" {
+			resp.URI = override.URI
+		}
+		if override.MUXS != "" {
+			resp.MUXS = override.MUXS
+		}
+		if override.Error != "" {
+			resp.Error = override.Error
+		}
+	}
+
+	return resp, nil
+}
+
+// instanceID returns MUXS or the ID6 of the hostname hash
+func (dr *DiscoveryResolver) instanceID() string {
+	if dr.MUXS != "" {
+		return dr.MUXS
+	}
+
+	dr.muxsOnce.Do(func() {
+		name, err := os.Hostname()
+		if err != nil {
+			name = "localhost"
+		}
+		dr.muxs = muxsID(name)
+	})
+
+	return dr.muxs
+}
+
+// muxsID derives a stable ID6 from a name
+func muxsID(name string) string {
+	return FormatID6(hash64([]byte(name)))
+}
+
+// forwardedValue returns the first value of a proxy header
+func forwardedValue(r *http.Request, header string) string {
+	v := r.Header.Get(header)
+	if i := strings.IndexByte(v, ','); i >= 0 {
+		v = v[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(v))
+}
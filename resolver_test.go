@@ -0,0 +1,84 @@
+package basicstation
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDiscoveryResolver(t *testing.T) {
+
+	dr := NewDiscoveryResolver("/traffic/{eui}")
+	dr.MUXS = "::1"
+
+	tcs := []struct {
+		name    string
+		target  string
+		headers map[string]string
+		uri     string
+	}{
+		{"plain", "http://lns.example.com/router-info", nil, "ws://lns.example.com/traffic/0000000000000001"},
+		{"tls", "https://lns.example.com:8443/router-info", nil, "wss://lns.example.com:8443/traffic/0000000000000001"},
+		{
+			"behind proxy",
+			"http://10.0.0.1:8080/router-info",
+			map[string]string{"X-Forwarded-Proto": "https, http", "X-Forwarded-Host": "lns.example.com"},
+			"wss://lns.example.com/traffic/0000000000000001",
+		},
+		{
+			"tls terminated upstream",
+			"https://10.0.0.1/router-info",
+			map[string]string{"X-Forwarded-Proto": "http"},
+			"ws://10.0.0.1/traffic/0000000000000001",
+		},
+	}
+
+	for _, tt := range tcs {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+
+			resp, err := dr.GetDiscoveryResponse(1, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.URI != tt.uri || resp.MUXS != "::1" {
+				t.Errorf("got %+v, want uri %s", resp, tt.uri)
+			}
+		})
+	}
+}
+
+func TestDiscoveryResolverOverride(t *testing.T) {
+
+	dr := NewDiscoveryResolver("")
+	dr.SetOverride(2, DiscoveryResponse{URI: "wss://other.example.com/2"})
+
+	r := httptest.NewRequest(http.MethodGet, "http://lns.example.com/router-info", nil)
+
+	resp, _ := dr.GetDiscoveryResponse(2, r)
+	if resp.URI != "wss://other.example.com/2" || resp.MUXS == "" {
+		t.Errorf("override got %+v", resp)
+	}
+
+	resp, _ = dr.GetDiscoveryResponse(1, r)
+	if resp.URI != "ws://lns.example.com/0000000000000001" {
+		t.Errorf("no override got %+v", resp)
+	}
+
+	dr.RemoveOverride(2)
+	resp, _ = dr.GetDiscoveryResponse(2, r)
+	if resp.URI != "ws://lns.example.com/0000000000000002" {
+		t.Errorf("removed override got %+v", resp)
+	}
+
+	// The instance id is stable
+	if id := muxsID("lns-1"); id != muxsID("lns-1") || id == muxsID("lns-2") {
+		t.Errorf("muxs id not derived from the name: %s", id)
+	}
+	if _, err := ParseID6(resp.MUXS); err != nil {
+		t.Errorf("muxs %q is not an ID6: %v", resp.MUXS, err)
+	}
+}
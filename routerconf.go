@@ -0,0 +1,496 @@
+package basicstation
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// RadioChannel defines an SX1301 channel configuration
+type RadioChannel struct {
+	Enable bool `json:"enable"`
+	Radio  uint `json:"radio"`
+	IF     int  `json:"if"`
+
+	// Extra holds fields not modelled above so they survive a round trip
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// LoraStdChannel is a Radio channel with additional parameters, unknown
+// fields are kept in the Extra of the embedded RadioChannel
+type LoraStdChannel struct {
+	RadioChannel
+	Bandwidth       int   `json:"bandwidth,omitempty"`
+	SpreadingFactor int   `json:"spread_factor,omitempty"`
+	ImplicitHeader  *bool `json:"implicit_hdr,omitempty"`
+}
+
+// FSKChannel is a Radio channel with FSK parameters, unknown fields are
+// kept in the Extra of the embedded RadioChannel
+type FSKChannel struct {
+	RadioChannel
+	Bandwidth int `json:"bandwidth,omitempty"`
+	Datarate  int `json:"datarate,omitempty"`
+}
+
+// MultiSFAll enables spreading factors on all SX1302 multi-SF channels
+type MultiSFAll struct {
+	SpreadingFactors []int `json:"spreading_factor_enable"`
+
+	// Extra holds fields not modelled above so they survive a round trip
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// Radio is an SX1301/SX1302 radio configuration
+type Radio struct {
+	Enable          bool     `json:"enable"`
+	Freq            uint32   `json:"freq"`
+	Type            string   `json:"type,omitempty"`
+	RSSIOffset      *float64 `json:"rssi_offset,omitempty"`
+	AntennaGain     *float64 `json:"antenna_gain,omitempty"`
+	TxEnable        *bool    `json:"tx_enable,omitempty"`
+	TxFreqMin       uint32   `json:"tx_freq_min,omitempty"`
+	TxFreqMax       uint32   `json:"tx_freq_max,omitempty"`
+	TxNotchFreq     uint32   `json:"tx_notch_freq,omitempty"`
+	SingleInputMode *bool    `json:"single_input_mode,omitempty"`
+
+	// Extra holds fields not modelled above so they survive a round trip
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// LBTChannel is a channel scanned before transmitting
+type LBTChannel struct {
+	Freq         uint32 `json:"freq_hz"`
+	ScanTime     int    `json:"scan_time_us"`
+	Bandwidth    int    `json:"bandwidth,omitempty"`
+	TransmitTime int    `json:"transmit_time_ms,omitempty"`
+
+	// Extra holds fields not modelled above so they survive a round trip
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// LBTConf is the listen before talk configuration of an SX1301 board
+type LBTConf struct {
+	Enable           bool         `json:"enable"`
+	RSSITarget       int          `json:"rssi_target"`
+	SX127xRSSIOffset *int         `json:"sx127x_rssi_offset,omitempty"`
+	Channels         []LBTChannel `json:"chan_cfg,omitempty"`
+
+	// Extra holds fields not modelled above so they survive a round trip
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// SX1261LBTConf is the listen before talk configuration of an SX1302 board
+type SX1261LBTConf struct {
+	Enable     bool         `json:"enable"`
+	RSSITarget int          `json:"rssi_target"`
+	Channels   []LBTChannel `json:"channels,omitempty"`
+
+	// Extra holds fields not modelled above so they survive a round trip
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// SX1261Conf is the SX1261 companion radio of an SX1302 board used for
+// listen before talk and spectral scan
+type SX1261Conf struct {
+	RSSIOffset   *int            `json:"rssi_offset,omitempty"`
+	SpectralScan json.RawMessage `json:"spectral_scan,omitempty"`
+	LBT          *SX1261LBTConf  `json:"lbt,omitempty"`
+
+	// Extra holds fields not modelled above so they survive a round trip
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// SX1301 defines how the channel plan maps to the individual SX1301 chips.
+// SX1302 boards share the layout and add the fields marked SX1302 only.
+type SX1301 struct {
+	LoRaWANPublic *bool          `json:"lorawan_public,omitempty"`
+	ClkSrc        *int           `json:"clksrc,omitempty"`
+	Device        string         `json:"device,omitempty"`
+	PPS           *bool          `json:"pps,omitempty"`
+	Radio0        Radio          `json:"radio_0"`
+	Radio1        Radio          `json:"radio_1"`
+	Channel0      RadioChannel   `json:"chan_multiSF_0"`
+	Channel1      RadioChannel   `json:"chan_multiSF_1"`
+	Channel2      RadioChannel   `json:"chan_multiSF_2"`
+	Channel3      RadioChannel   `json:"chan_multiSF_3"`
+	Channel4      RadioChannel   `json:"chan_multiSF_4"`
+	Channel5      RadioChannel   `json:"chan_multiSF_5"`
+	Channel6      RadioChannel   `json:"chan_multiSF_6"`
+	Channel7      RadioChannel   `json:"chan_multiSF_7"`
+	ChannelLora   LoraStdChannel `json:"chan_Lora_std"`
+	ChannelFSK    FSKChannel     `json:"chan_FSK"`
+	LBT           *LBTConf       `json:"lbt_cfg,omitempty"`
+
+	// SX1302 only
+	FullDuplex     *bool       `json:"full_duplex,omitempty"`
+	ChannelMultiSF *MultiSFAll `json:"chan_multiSF_All,omitempty"`
+	SX1261         *SX1261Conf `json:"sx1261_conf,omitempty"`
+
+	// Extra holds fields not modelled above so they survive a round trip
+	Extra map[string]json.RawMessage `json:"-"`
+
+	// absent are the radio and channel sections missing from the decoded
+	// object, they are left out again unless set since
+	absent map[string]bool
+}
+
+// SX1302 defines how the channel plan maps to the individual SX1302 chips
+type SX1302 = SX1301
+
+// Beaconing configures class B beacons. Layout holds the beacon time, info
+// descriptor and total length in bytes, Freqs the beacon frequencies.
+type Beaconing struct {
+	DR     int    `json:"DR"`
+	Layout [3]int `json:"layout"`
+	Freqs  []uint `json:"freqs"`
+
+	// Extra holds fields not modelled above so they survive a round trip
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// RouterConf message specifies a channelplan for the station and defines
+// some basic operation modes. NOCCA disables clear channel assessment,
+// NODC duty cycle limits and NODWELL dwell time limits, they are meant for
+// testing only. UpChannels restricts the uplink channels accepted by the
+// station to [freq, minDR, maxDR] entries.
+type RouterConf struct {
+	MessageType string     `json:"msgtype"`
+	DRs         [][]int    `json:",omitempty"`
+	NetID       [][]uint   `json:",omitempty"`
+	JoinEUI     [][]uint   `json:"JoinEui,omitempty"`
+	Region      string     `json:"region"`
+	HWSPEC      string     `json:"hwspec"`
+	FreqRange   []uint     `json:"freq_range,omitempty"`
+	SX1301s     []SX1301   `json:"sx1301_conf,omitempty"`
+	SX1302s     []SX1302   `json:"sx1302_conf,omitempty"`
+	UpChannels  [][]uint   `json:"upchannels,omitempty"`
+	Beaconing   *Beaconing `json:"bcning,omitempty"`
+	NOCCA       bool       `json:"nocca,omitempty"`
+	NODC        bool       `json:"nodc,omitempty"`
+	NODWELL     bool       `json:"nodwell,omitempty"`
+	MaxEIRP     *int       `json:"max_eirp,omitempty"`
+	MuxTime     float64    `json:"MuxTime,omitempty"`
+
+	// Extra holds fields not modelled above so they survive a round trip
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// routerConf and sx1301 have the fields but not the json methods of the
+// types they are converted from
+type routerConf RouterConf
+type sx1301 SX1301
+
+// MarshalJSON satisfies json.Marshaler
+func (rc RouterConf) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(routerConf(rc))
+	if err != nil {
+		return nil, err
+	}
+	return mergeExtra(b, reflect.ValueOf(rc), nil)
+}
+
+// UnmarshalJSON satisfies json.Unmarshaler
+func (rc *RouterConf) UnmarshalJSON(b []byte) error {
+	var conf routerConf
+	if err := json.Unmarshal(b, &conf); err != nil {
+		return err
+	}
+
+	if _, err := splitExtra(b, reflect.ValueOf(&conf).Elem()); err != nil {
+		return err
+	}
+
+	*rc = RouterConf(conf)
+	return nil
+}
+
+// MarshalJSON satisfies json.Marshaler
+func (s SX1301) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(sx1301(s))
+	if err != nil {
+		return nil, err
+	}
+
+	// Sections the station did not send stay out unless they were set
+	v := reflect.ValueOf(s)
+	omit := func(name string, f reflect.Value) bool {
+		return s.absent[name] && f.IsZero()
+	}
+
+	return mergeExtra(b, v, omit)
+}
+
+// UnmarshalJSON satisfies json.Unmarshaler
+func (s *SX1301) UnmarshalJSON(b []byte) error {
+	var conf sx1301
+	if err := json.Unmarshal(b, &conf); err != nil {
+		return err
+	}
+
+	fields, err := splitExtra(b, reflect.ValueOf(&conf).Elem())
+	if err != nil {
+		return err
+	}
+
+	t := reflect.TypeOf(conf)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Type.Kind() != reflect.Struct {
+			continue
+		}
+		name := jsonName(f)
+		if _, ok := lookupField(fields, name); !ok {
+			if conf.absent == nil {
+				conf.absent = make(map[string]bool)
+			}
+			conf.absent[name] = true
+		}
+	}
+
+	*s = SX1301(conf)
+	return nil
+}
+
+// jsonName returns the json object key of a struct field, empty if the
+// field is not encoded
+func jsonName(f reflect.StructField) string {
+	tag := f.Tag.Get("json")
+	if tag == "-" || f.PkgPath != "" {
+		return ""
+	}
+	if name := strings.Split(tag, ",")[0]; name != "" {
+		return name
+	}
+	return f.Name
+}
+
+// jsonFieldNames returns the json object keys of a struct type
+func jsonFieldNames(t reflect.Type) []string {
+	var names []string
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			names = append(names, jsonFieldNames(f.Type)...)
+			continue
+		}
+		if name := jsonName(f); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// lookupField finds a json object key as encoding/json does, case
+// insensitively
+func lookupField(fields map[string]json.RawMessage, name string) (string, bool) {
+	if _, ok := fields[name]; ok {
+		return name, true
+	}
+	for k := range fields {
+		if strings.EqualFold(k, name) {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// extraField returns the Extra map field of a struct value, promoted from an
+// embedded struct or not, and whether it has one
+func extraField(v reflect.Value) (reflect.Value, bool) {
+	f := v.FieldByName("Extra")
+	if !f.IsValid() || f.Type() != reflect.TypeOf(map[string]json.RawMessage(nil)) {
+		return reflect.Value{}, false
+	}
+	return f, true
+}
+
+// nested calls fn for the struct fields of v holding json objects, pointers
+// to them and slices of them, with the json key of the field
+func nested(v reflect.Value, fn func(name string, f reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name := jsonName(sf)
+		if sf.Anonymous || name == "" {
+			continue
+		}
+
+		f := v.Field(i)
+		switch {
+		case f.Kind() == reflect.Struct:
+		case f.Kind() == reflect.Ptr && f.Type().Elem().Kind() == reflect.Struct:
+		case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Struct:
+		default:
+			continue
+		}
+		fn(name, f)
+	}
+}
+
+// splitExtra stores the fields of a json object that do not decode into a
+// field of the struct v in its Extra, and does so for the objects nested in
+// it. v must be addressable. It returns the fields of the object.
+func splitExtra(b []byte, v reflect.Value) (map[string]json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil || fields == nil {
+		// Not an object, the decoder already reported it or it is null
+		return nil, nil
+	}
+
+	if extra, ok := extraField(v); ok {
+		m, err := unknownFields(fields, v.Type())
+		if err != nil {
+			return nil, err
+		}
+		extra.Set(reflect.ValueOf(m))
+	}
+
+	var err error
+	nested(v, func(name string, f reflect.Value) {
+		key, ok := lookupField(fields, name)
+		if !ok || err != nil {
+			return
+		}
+		err = splitNested(fields[key], f)
+	})
+
+	return fields, err
+}
+
+// splitNested is splitExtra for a field value
+func splitNested(b []byte, f reflect.Value) error {
+	switch f.Kind() {
+	case reflect.Ptr:
+		if f.IsNil() {
+			return nil
+		}
+		return splitNested(b, f.Elem())
+	case reflect.Slice:
+		var items []json.RawMessage
+		if err := json.Unmarshal(b, &items); err != nil {
+			return nil
+		}
+		for i := 0; i < f.Len() && i < len(items); i++ {
+			if err := splitNested(items[i], f.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Types with their own json methods did this already
+	if _, ok := f.Addr().Interface().(json.Unmarshaler); ok {
+		return nil
+	}
+
+	_, err := splitExtra(b, f)
+	return err
+}
+
+// unknownFields returns the fields of a json object that do not decode into
+// a field of the struct type, nil if there are none
+func unknownFields(fields map[string]json.RawMessage, t reflect.Type) (map[string]json.RawMessage, error) {
+	known := jsonFieldNames(t)
+
+	var extra map[string]json.RawMessage
+next:
+	for k, v := range fields {
+		for _, name := range known {
+			// encoding/json matches keys case insensitively
+			if strings.EqualFold(k, name) {
+				continue next
+			}
+		}
+		if extra == nil {
+			extra = make(map[string]json.RawMessage)
+		}
+		// Compact as json.Marshal does, so values compare equal after a
+		// round trip
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, v); err != nil {
+			return nil, err
+		}
+		extra[k] = buf.Bytes()
+	}
+
+	return extra, nil
+}
+
+// mergeExtra adds the Extra fields of the struct v and of the objects nested
+// in it to its json encoding b, modelled fields win. Fields for which omit
+// returns true are left out.
+func mergeExtra(b []byte, v reflect.Value, omit func(name string, f reflect.Value) bool) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+
+	changed := false
+
+	if extra, ok := extraField(v); ok {
+		for k, raw := range extra.Interface().(map[string]json.RawMessage) {
+			if _, ok := fields[k]; !ok {
+				fields[k] = raw
+				changed = true
+			}
+		}
+	}
+
+	var err error
+	nested(v, func(name string, f reflect.Value) {
+		raw, ok := fields[name]
+		if !ok || err != nil {
+			return
+		}
+		if omit != nil && omit(name, f) {
+			delete(fields, name)
+			changed = true
+			return
+		}
+		var merged []byte
+		if merged, err = mergeNested(raw, f); err == nil && !bytes.Equal(merged, raw) {
+			fields[name] = merged
+			changed = true
+		}
+	})
+	if err != nil || !changed {
+		return b, err
+	}
+
+	return json.Marshal(fields)
+}
+
+// mergeNested is mergeExtra for a field value
+func mergeNested(b []byte, f reflect.Value) ([]byte, error) {
+	switch f.Kind() {
+	case reflect.Ptr:
+		if f.IsNil() {
+			return b, nil
+		}
+		return mergeNested(b, f.Elem())
+	case reflect.Slice:
+		var items []json.RawMessage
+		if err := json.Unmarshal(b, &items); err != nil || len(items) != f.Len() {
+			return b, nil
+		}
+		for i := range items {
+			merged, err := mergeNested(items[i], f.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			items[i] = merged
+		}
+		return json.Marshal(items)
+	}
+
+	// Types with their own json methods did this already
+	if _, ok := f.Interface().(json.Marshaler); ok {
+		return b, nil
+	}
+
+	return mergeExtra(b, f, nil)
+}
@@ -0,0 +1,127 @@
+package basicstation
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// ShutdownError reports the sessions Shutdown had to force close because
+// they did not end before its context was done
+type ShutdownError struct {
+	EUIs []uint64
+	Err  error
+}
+
+// Error satisifies error interface
+func (s ShutdownError) Error() string {
+	return fmt.Sprintf("%d gateway sessions force closed: %v", len(s.EUIs), s.Err)
+}
+
+// Unwrap returns the context error
+func (s ShutdownError) Unwrap() error {
+	return s.Err
+}
+
+// sessionSet tracks the sessions served by GatewayHandler until they end
+type sessionSet struct {
+	sync.Mutex
+	closing bool
+	active  map[*Gateway]chan struct{}
+}
+
+func (ss *sessionSet) isClosing() bool {
+	ss.Lock()
+	defer ss.Unlock()
+
+	return ss.closing
+}
+
+// add tracks a session, it fails once shutdown started
+func (ss *sessionSet) add(gw *Gateway) bool {
+	ss.Lock()
+	defer ss.Unlock()
+
+	if ss.closing {
+		return false
+	}
+	if ss.active == nil {
+		ss.active = make(map[*Gateway]chan struct{})
+	}
+	ss.active[gw] = make(chan struct{})
+
+	return true
+}
+
+// remove marks a session as ended
+func (ss *sessionSet) remove(gw *Gateway) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	if done, ok := ss.active[gw]; ok {
+		close(done)
+		delete(ss.active, gw)
+	}
+}
+
+// close refuses new sessions and returns the active ones
+func (ss *sessionSet) close() map[*Gateway]chan struct{} {
+	ss.Lock()
+	defer ss.Unlock()
+
+	ss.closing = true
+
+	active := make(map[*Gateway]chan struct{}, len(ss.active))
+	for gw, done := range ss.active {
+		active[gw] = done
+	}
+	return active
+}
+
+// Shutdown gracefully stops the gateway and discovery handlers of the
+// environment. New connections are refused with 503 Service Unavailable,
+// every station is sent a going away close frame and Shutdown waits for
+// the sessions to end. Sessions still running when ctx is done are force
+// closed and reported by a ShutdownError.
+func (env *Environment) Shutdown(ctx context.Context) error {
+	active := env.sessions.close()
+
+	for gw := range active {
+		if err := gw.sendClose(websocket.CloseGoingAway, "server shutting down"); err != nil {
+			env.Log.Debug().
+				Err(err).
+				Uint64("gweui", gw.EUI).
+				Msg("send shutdown close frame failed")
+		}
+	}
+
+	var forced []uint64
+	for gw, done := range active {
+		select {
+		case <-done:
+			continue
+		case <-ctx.Done():
+		}
+
+		// The session may have ended as the context expired
+		select {
+		case <-done:
+		default:
+			gw.conn.Close()
+			forced = append(forced, gw.EUI)
+		}
+	}
+
+	if len(forced) > 0 {
+		sort.Slice(forced, func(i, j int) bool { return forced[i] < forced[j] })
+		env.Log.Warn().
+			Int("sessions", len(forced)).
+			Msg("gateway sessions force closed on shutdown")
+		return ShutdownError{EUIs: forced, Err: ctx.Err()}
+	}
+
+	return nil
+}
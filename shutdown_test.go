@@ -0,0 +1,72 @@
+package basicstation
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+func TestShutdown(t *testing.T) {
+
+	rs := newRecordingServer()
+	rs.conf = newRouterConf()
+	env := &Environment{Server: rs}
+
+	router := mux.NewRouter()
+	router.Handle(DiscoveryURL, DiscoveryHandler{Env: env})
+	router.Handle("/{eui}", GatewayHandler{Env: env})
+	s := httptest.NewServer(router)
+	defer s.Close()
+
+	// Station 1 reads and so answers the close frame, station 2 does not
+	ws1 := dialStation(t, s, "0000000000000001")
+	defer ws1.Close()
+	<-rs.gws
+	ws2 := dialStation(t, s, "0000000000000002")
+	defer ws2.Close()
+	<-rs.gws
+
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := ws1.ReadMessage(); err != nil {
+				closed <- err
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	err := env.Shutdown(ctx)
+
+	var se ShutdownError
+	if !errors.As(err, &se) || !reflect.DeepEqual(se.EUIs, []uint64{2}) {
+		t.Errorf("shutdown got %v, want station 2 force closed", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("shutdown error %v does not wrap the context error", err)
+	}
+
+	if err := <-closed; !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("station 1 read got %v, want going away close", err)
+	}
+
+	// New connections are refused
+	base := "ws" + strings.TrimPrefix(s.URL, "http")
+	for _, path := range []string{"/0000000000000003", DiscoveryURL} {
+		_, resp, err := websocket.DefaultDialer.Dial(base+path, nil)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("dial %s after shutdown got %v, want 503", path, err)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package basicstation
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Stats is a snapshot of the gateway statistics. The counters are read at
+// a single point in time, RoundTrip is read right after them.
+type Stats struct {
+	// Connected is when the session started, Uptime how long it lasted so far
+	Connected time.Time
+	Uptime    time.Duration
+
+	RecvTextMsg   uint64
+	RecvBinaryMsg uint64
+	RecvBytes     uint64
+	RecvByType    map[string]uint64
+
+	WriteTextOk      uint64
+	WriteBinaryOk    uint64
+	WriteTextError   uint64
+	WriteBinaryError uint64
+	WriteNoConnError uint64
+	SentBytes        uint64
+	SentByType       map[string]uint64
+
+	// DecodeErrors is the total of DecodeErrorsByKind
+	DecodeErrors       uint64
+	DecodeErrorsByKind map[string]uint64
+
+	// PingsSent and PongsReceived count keepalive exchanges, LastPong is
+	// when the station last answered and PeerTimeouts how often it went
+	// silent for longer than the keepalive allows
+	PingsSent     uint64
+	PongsReceived uint64
+	LastPong      time.Time
+	PeerTimeouts  uint64
+
+	// DownlinksSent counts dnmsg and dnsched entries written to the station,
+	// DownlinksConfirmed those the station reported with a dntxed
+	DownlinksSent      uint64
+	DownlinksConfirmed uint64
+
+	// RoundTrip is the latency between the LNS and the station measured
+	// with MuxTime/RefTime
+	RoundTrip RoundTrip
+}
+
+// Decode error kinds of Stats.DecodeErrorsByKind
+const (
+	DecodeErrorMalformedJSON      = "malformed_json"
+	DecodeErrorUnsupportedMsgType = "unsupported_msgtype"
+	DecodeErrorInvalidMessage     = "invalid_message"
+)
+
+// gatewayStats are the live counters behind Stats. The uint64 counters are
+// updated atomically, they come first to keep them 64-bit aligned. Updates
+// hold mu shared so they run concurrently, a snapshot holds it exclusive so
+// it sees no update half done.
+type gatewayStats struct {
+	recvText           uint64
+	recvBinary         uint64
+	recvBytes          uint64
+	writeTextOk        uint64
+	writeBinaryOk      uint64
+	writeTextError     uint64
+	writeBinaryError   uint64
+	writeNoConn        uint64
+	sentBytes          uint64
+	decodeErrors       uint64
+	downlinksSent      uint64
+	downlinksConfirmed uint64
+	pingsSent          uint64
+	pongsReceived      uint64
+	peerTimeouts       uint64
+	lastPong           int64
+	connected          int64
+	disconnected       int64
+
+	mu           sync.RWMutex
+	recvByType   keyedCounters
+	sentByType   keyedCounters
+	decodeByKind keyedCounters
+}
+
+// keyedCounters is a set of atomic counters created on first use
+type keyedCounters struct {
+	sync.RWMutex
+	m map[string]*uint64
+}
+
+func (k *keyedCounters) add(key string, delta uint64) {
+	k.RLock()
+	p, ok := k.m[key]
+	k.RUnlock()
+
+	if !ok {
+		k.Lock()
+		if p, ok = k.m[key]; !ok {
+			if k.m == nil {
+				k.m = make(map[string]*uint64)
+			}
+			p = new(uint64)
+			k.m[key] = p
+		}
+		k.Unlock()
+	}
+
+	atomic.AddUint64(p, delta)
+}
+
+func (k *keyedCounters) snapshot() map[string]uint64 {
+	k.RLock()
+	defer k.RUnlock()
+
+	m := make(map[string]uint64, len(k.m))
+	for key, p := range k.m {
+		m[key] = atomic.LoadUint64(p)
+	}
+	return m
+}
+
+func (s *gatewayStats) start(t time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	atomic.StoreInt64(&s.connected, t.UnixNano())
+	atomic.StoreInt64(&s.disconnected, 0)
+}
+
+func (s *gatewayStats) stop(t time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	atomic.StoreInt64(&s.disconnected, t.UnixNano())
+}
+
+func (s *gatewayStats) received(msgType string, n int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	atomic.AddUint64(&s.recvText, 1)
+	atomic.AddUint64(&s.recvBytes, uint64(n))
+	s.recvByType.add(msgType, 1)
+}
+
+func (s *gatewayStats) receivedBinary(n int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	atomic.AddUint64(&s.recvBinary, 1)
+	atomic.AddUint64(&s.recvBytes, uint64(n))
+}
+
+func (s *gatewayStats) decodeError(err error, n int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	atomic.AddUint64(&s.recvText, 1)
+	atomic.AddUint64(&s.recvBytes, uint64(n))
+	atomic.AddUint64(&s.decodeErrors, 1)
+	s.decodeByKind.add(decodeErrorKind(err), 1)
+}
+
+func (s *gatewayStats) written(m outboundMsg, n int, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	switch {
+	case m.mt != websocket.TextMessage && err != nil:
+		atomic.AddUint64(&s.writeBinaryError, 1)
+	case m.mt != websocket.TextMessage:
+		atomic.AddUint64(&s.writeBinaryOk, 1)
+		atomic.AddUint64(&s.sentBytes, uint64(n))
+	case err != nil:
+		atomic.AddUint64(&s.writeTextError, 1)
+	default:
+		atomic.AddUint64(&s.writeTextOk, 1)
+		atomic.AddUint64(&s.sentBytes, uint64(n))
+		atomic.AddUint64(&s.downlinksSent, uint64(m.downlinks))
+		s.sentByType.add(m.msgType, 1)
+	}
+}
+
+// add adds delta to one of the counters
+func (s *gatewayStats) add(counter *uint64, delta uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	atomic.AddUint64(counter, delta)
+}
+
+// pong records a keepalive answer of the station
+func (s *gatewayStats) pong(t time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	atomic.AddUint64(&s.pongsReceived, 1)
+	atomic.StoreInt64(&s.lastPong, t.UnixNano())
+}
+
+// Stats returns a snapshot of the gateway statistics, see Snapshot
+func (gw *Gateway) Stats() Stats {
+	return gw.Snapshot()
+}
+
+// Snapshot returns a copy of the gateway statistics, consistent across the
+// counters
+func (gw *Gateway) Snapshot() Stats {
+	snap := gw.stats.snapshot()
+	snap.RoundTrip = gw.RoundTrip()
+
+	return snap
+}
+
+func (s *gatewayStats) snapshot() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := Stats{
+		RecvTextMsg:        atomic.LoadUint64(&s.recvText),
+		RecvBinaryMsg:      atomic.LoadUint64(&s.recvBinary),
+		RecvBytes:          atomic.LoadUint64(&s.recvBytes),
+		RecvByType:         s.recvByType.snapshot(),
+		WriteTextOk:        atomic.LoadUint64(&s.writeTextOk),
+		WriteBinaryOk:      atomic.LoadUint64(&s.writeBinaryOk),
+		WriteTextError:     atomic.LoadUint64(&s.writeTextError),
+		WriteBinaryError:   atomic.LoadUint64(&s.writeBinaryError),
+		WriteNoConnError:   atomic.LoadUint64(&s.writeNoConn),
+		SentBytes:          atomic.LoadUint64(&s.sentBytes),
+		SentByType:         s.sentByType.snapshot(),
+		DecodeErrors:       atomic.LoadUint64(&s.decodeErrors),
+		DecodeErrorsByKind: s.decodeByKind.snapshot(),
+		DownlinksSent:      atomic.LoadUint64(&s.downlinksSent),
+		DownlinksConfirmed: atomic.LoadUint64(&s.downlinksConfirmed),
+		PingsSent:          atomic.LoadUint64(&s.pingsSent),
+		PongsReceived:      atomic.LoadUint64(&s.pongsReceived),
+		PeerTimeouts:       atomic.LoadUint64(&s.peerTimeouts),
+	}
+
+	if lastPong := atomic.LoadInt64(&s.lastPong); lastPong != 0 {
+		snap.LastPong = time.Unix(0, lastPong)
+	}
+
+	if connected := atomic.LoadInt64(&s.connected); connected != 0 {
+		snap.Connected = time.Unix(0, connected)
+
+		end := time.Now()
+		if disconnected := atomic.LoadInt64(&s.disconnected); disconnected != 0 {
+			end = time.Unix(0, disconnected)
+		}
+		snap.Uptime = end.Sub(snap.Connected)
+	}
+
+	return snap
+}
+
+// decodeErrorKind classifies a decode error for Stats.DecodeErrorsByKind
+func decodeErrorKind(err error) string {
+	var syntaxError *json.SyntaxError
+	var unsupported UnsupportedMsgType
+
+	switch {
+	case errors.As(err, &syntaxError), errors.Is(err, io.ErrUnexpectedEOF):
+		return DecodeErrorMalformedJSON
+	case errors.As(err, &unsupported):
+		return DecodeErrorUnsupportedMsgType
+	default:
+		return DecodeErrorInvalidMessage
+	}
+}
+
+// msgTypeOf returns the msgtype of a message sent or received
+func msgTypeOf(msg interface{}) string {
+	switch msg.(type) {
+	case RouterConf, *RouterConf:
+		return RouterConfMsgName
+	case Downlink, *Downlink:
+		return DownlinkMsgName
+	case DnSched, *DnSched:
+		return DnSchedMsgName
+	case TimeSync, *TimeSync:
+		return TimeSyncMsgName
+	case RunCmd, *RunCmd:
+		return RunCmdMsgName
+	case RemoteShellCtrl, *RemoteShellCtrl, RemoteShellStatus, *RemoteShellStatus:
+		return RemoteShellMsgName
+	case Version, *Version:
+		return "version"
+	case JoinRequest, *JoinRequest:
+		return "jreq"
+	case Uplink, *Uplink:
+		return "updf"
+	case ProprietaryFrame, *ProprietaryFrame:
+		return "propdf"
+	case DnTxed, *DnTxed:
+		return "dntxed"
+	}
+	return "unknown"
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
@@ -0,0 +1,193 @@
+package basicstation
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// TimeSyncMsgName is the time synchronisation message type field value
+	TimeSyncMsgName = "timesync"
+
+	// gpsLeapSeconds is the UTC leap second count since the GPS epoch
+	gpsLeapSeconds = 18
+
+	// xtimeCounterMask selects the microsecond counter bits of an xtime, the
+	// upper bits identify the radio and session the counter belongs to
+	xtimeCounterMask = 1<<48 - 1
+)
+
+// gpsEpoch is the start of GPS time
+var gpsEpoch = time.Date(1980, time.January, 6, 0, 0, 0, 0, time.UTC)
+
+// GPSTime returns the GPS time in microseconds of a wall clock time
+func GPSTime(t time.Time) int64 {
+	return int64(t.Sub(gpsEpoch)/time.Microsecond) + gpsLeapSeconds*1000000
+}
+
+// TimeSync message is sent by the station to request the GPS time, and by
+// the LNS to answer a request or to transfer GPS time to the station
+type TimeSync struct {
+	MsgType string  `json:"msgtype"`
+	TxTime  float64 `json:"txtime,omitempty"`
+	XTime   int64   `json:"xtime,omitempty"`
+	GPSTime int64   `json:"gpstime,omitempty"`
+	RefTime float64 `json:"RefTime,omitempty"`
+}
+
+// timeRef tracks the offset between a station xtime session and GPS time
+type timeRef struct {
+	sync.Mutex
+	valid   bool
+	session int64
+	offset  int64
+
+	// last uplink xtime and when it was received, used once as the anchor
+	// of an unsolicited timesync message
+	lastXTime int64
+	lastRecv  time.Time
+}
+
+// update records a xtime/gpstime pair observed by or sent to the station
+func (ref *timeRef) update(xtime, gpstime int64) {
+	ref.Lock()
+	defer ref.Unlock()
+
+	ref.valid = true
+	ref.session = xtime &^ xtimeCounterMask
+	ref.offset = gpstime - xtime&xtimeCounterMask
+}
+
+// received records the radio context of an uplink
+func (ref *timeRef) received(rctx RxContext, at time.Time) {
+	if rctx.XTime == 0 {
+		return
+	}
+
+	if rctx.GPSTime != 0 {
+		ref.update(rctx.XTime, int64(rctx.GPSTime))
+	}
+
+	ref.Lock()
+	ref.lastXTime = rctx.XTime
+	ref.lastRecv = at
+	ref.Unlock()
+}
+
+// takeAnchor returns the last uplink xtime and clears it, so an anchor is
+// never sent twice
+func (ref *timeRef) takeAnchor() (xtime int64, at time.Time) {
+	ref.Lock()
+	defer ref.Unlock()
+
+	xtime, at = ref.lastXTime, ref.lastRecv
+	ref.lastXTime = 0
+
+	return xtime, at
+}
+
+// GPSOffset returns the offset in microseconds between the station xtime
+// counter and GPS time. ok is false until the station reported GPS time in
+// an uplink or a timesync transfer was sent.
+func (gw *Gateway) GPSOffset() (offset int64, ok bool) {
+	gw.timeRef.Lock()
+	defer gw.timeRef.Unlock()
+
+	return gw.timeRef.offset, gw.timeRef.valid
+}
+
+// XTimeToGPS converts a station xtime to GPS time in microseconds. ok is
+// false if the offset is unknown or the xtime is from another session.
+func (gw *Gateway) XTimeToGPS(xtime int64) (gpstime int64, ok bool) {
+	gw.timeRef.Lock()
+	defer gw.timeRef.Unlock()
+
+	if !gw.timeRef.valid || xtime&^xtimeCounterMask != gw.timeRef.session {
+		return 0, false
+	}
+
+	return xtime&xtimeCounterMask + gw.timeRef.offset, true
+}
+
+// GPSToXTime converts a GPS time in microseconds to a station xtime of the
+// current session. ok is false if the offset is unknown.
+func (gw *Gateway) GPSToXTime(gpstime int64) (xtime int64, ok bool) {
+	gw.timeRef.Lock()
+	defer gw.timeRef.Unlock()
+
+	if !gw.timeRef.valid {
+		return 0, false
+	}
+
+	return gw.timeRef.session | (gpstime-gw.timeRef.offset)&xtimeCounterMask, true
+}
+
+// SendTimeSync transfers GPS time to the station by telling it the GPS time
+// in microseconds of a xtime. The pair is trusted as exact and becomes the
+// xtime to GPS offset of the session.
+func (gw *Gateway) SendTimeSync(xtime, gpstime int64) error {
+	if err := gw.transferTimeSync(xtime, gpstime); err != nil {
+		return err
+	}
+
+	gw.timeRef.update(xtime, gpstime)
+
+	return nil
+}
+
+// transferTimeSync sends a timesync transfer without touching the offset
+func (gw *Gateway) transferTimeSync(xtime, gpstime int64) error {
+	return gw.WriteJSON(&TimeSync{
+		MsgType: TimeSyncMsgName,
+		XTime:   xtime,
+		GPSTime: gpstime,
+	})
+}
+
+// sendTimeSyncFromUplink sends an unsolicited timesync anchored at the
+// uplink received since the last transfer. Its GPS time is estimated from
+// the wall clock time of the reception less half the round trip time, so it
+// is only as accurate as the backhaul latency is symmetric. The estimate is
+// not used as the offset of the session.
+func (gw *Gateway) sendTimeSyncFromUplink() error {
+	xtime, at := gw.timeRef.takeAnchor()
+	if xtime == 0 {
+		return errors.New("no uplink received since the last timesync")
+	}
+
+	at = at.Add(-gw.RoundTrip().Smoothed / 2)
+
+	return gw.transferTimeSync(xtime, GPSTime(at))
+}
+
+// answerTimeSync answers a station timesync request with the current GPS time
+func (gw *Gateway) answerTimeSync(req TimeSync) error {
+	return gw.WriteJSON(&TimeSync{
+		MsgType: TimeSyncMsgName,
+		TxTime:  req.TxTime,
+		GPSTime: GPSTime(time.Now()),
+	})
+}
+
+// runTimeSync periodically sends unsolicited timesync messages until done.
+// Stations with a GPS know GPS time and are left alone.
+func (gw *Gateway) runTimeSync(done <-chan struct{}, log Logger) {
+	if gw.Capabilities.Has(CapGPS) {
+		return
+	}
+
+	ticker := time.NewTicker(gw.TimeSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := gw.sendTimeSyncFromUplink(); err != nil {
+				log.Debug(gw.EUI, "unsolicited timesync not sent", err)
+			}
+		}
+	}
+}
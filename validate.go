@@ -0,0 +1,239 @@
+package basicstation
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidationError reports an invalid router configuration field. Field is
+// the json path of the field, such as sx1301_conf[0].chan_multiSF_3.if
+type ValidationError struct {
+	Field  string
+	Value  interface{}
+	Reason string
+}
+
+// Error satisifies error interface
+func (v ValidationError) Error() string {
+	return fmt.Sprintf("%s=%v: %s", v.Field, v.Value, v.Reason)
+}
+
+// ValidationErrors lists every problem found in a router configuration
+type ValidationErrors []ValidationError
+
+// Error satisifies error interface
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, e := range v {
+		msgs[i] = e.Error()
+	}
+	return "invalid router_config: " + strings.Join(msgs, "; ")
+}
+
+// validator collects validation errors under a field path prefix
+type validator struct {
+	prefix string
+	errs   ValidationErrors
+}
+
+func (v *validator) fail(field string, value interface{}, format string, args ...interface{}) {
+	v.errs = append(v.errs, ValidationError{
+		Field:  v.prefix + field,
+		Value:  value,
+		Reason: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *validator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+// Validate checks the router configuration against the region, when known,
+// and the SX1301/SX1302 hardware constraints. The error is ValidationErrors.
+func (rc RouterConf) Validate() error {
+	var v validator
+
+	// Stations support regions this package has no parameters for, those
+	// only get the structural checks
+	reg, _ := lookupRegion(rc.Region)
+
+	if rc.MaxEIRP != nil && reg != nil && *rc.MaxEIRP > reg.maxEIRP {
+		v.fail("max_eirp", *rc.MaxEIRP, "exceeds the %s limit of %d dBm", reg.name, reg.maxEIRP)
+	}
+
+	validFreqRange := false
+	if rc.FreqRange != nil {
+		switch {
+		case len(rc.FreqRange) != 2:
+			v.fail("freq_range", rc.FreqRange, "must be [min, max]")
+		case rc.FreqRange[0] >= rc.FreqRange[1]:
+			v.fail("freq_range", rc.FreqRange, "min must be below max")
+		case reg != nil && (rc.FreqRange[0] < reg.freqRange[0] || rc.FreqRange[1] > reg.freqRange[1]):
+			v.fail("freq_range", rc.FreqRange, "outside the %s band %v", reg.name, reg.freqRange)
+		default:
+			validFreqRange = true
+		}
+	}
+
+	if rc.DRs != nil {
+		validateDRs(&v, rc.DRs)
+	}
+
+	boards := []struct {
+		name string
+		conf []SX1301
+	}{
+		{"sx1301_conf", rc.SX1301s},
+		{"sx1302_conf", rc.SX1302s},
+	}
+	for _, b := range boards {
+		for i, board := range b.conf {
+			bv := validator{prefix: fmt.Sprintf("%s[%d].", b.name, i)}
+			board.validate(&bv)
+			if validFreqRange {
+				board.validateFreqRange(&bv, rc.FreqRange)
+			}
+			v.errs = append(v.errs, bv.errs...)
+		}
+	}
+
+	return v.err()
+}
+
+// validateDRs checks the shape of a [SF, BW, downlink only] DR table
+func validateDRs(v *validator, drs [][]int) {
+	if len(drs) != 16 {
+		v.fail("DRs", len(drs), "must have 16 entries")
+	}
+
+	for i, dr := range drs {
+		field := fmt.Sprintf("DRs[%d]", i)
+		if len(dr) != 3 {
+			v.fail(field, dr, "must be [SF, BW, DNONLY]")
+			continue
+		}
+
+		sf, bw, dnonly := dr[0], dr[1], dr[2]
+		switch {
+		case sf == -1:
+			// undefined
+		case sf == 0:
+			// FSK
+		case sf < 5 || sf > 12:
+			v.fail(field, dr, "spreading factor must be 5 to 12, 0 for FSK or -1 for undefined")
+		case bw != 125 && bw != 250 && bw != 500:
+			v.fail(field, dr, "bandwidth must be 125, 250 or 500 kHz")
+		}
+		if dnonly != 0 && dnonly != 1 {
+			v.fail(field, dr, "downlink only flag must be 0 or 1")
+		}
+	}
+}
+
+// Validate checks the board configuration against the radio and IF
+// constraints of the SX1301/SX1302. The error is ValidationErrors.
+func (s SX1301) Validate() error {
+	var v validator
+	s.validate(&v)
+	return v.err()
+}
+
+// boardChannel is a channel of a board configuration with its field name
+type boardChannel struct {
+	name string
+	ch   RadioChannel
+	bw   int
+}
+
+func (s SX1301) channels() []boardChannel {
+	return []boardChannel{
+		{"chan_multiSF_0", s.Channel0, 125000},
+		{"chan_multiSF_1", s.Channel1, 125000},
+		{"chan_multiSF_2", s.Channel2, 125000},
+		{"chan_multiSF_3", s.Channel3, 125000},
+		{"chan_multiSF_4", s.Channel4, 125000},
+		{"chan_multiSF_5", s.Channel5, 125000},
+		{"chan_multiSF_6", s.Channel6, 125000},
+		{"chan_multiSF_7", s.Channel7, 125000},
+		{"chan_Lora_std", s.ChannelLora.RadioChannel, s.ChannelLora.Bandwidth},
+		{"chan_FSK", s.ChannelFSK.RadioChannel, s.ChannelFSK.Bandwidth},
+	}
+}
+
+func (s SX1301) validate(v *validator) {
+	radios := []Radio{s.Radio0, s.Radio1}
+	for i, r := range radios {
+		if r.Enable && r.Freq == 0 {
+			v.fail(fmt.Sprintf("radio_%d.freq", i), r.Freq, "enabled radio has no centre frequency")
+		}
+	}
+
+	if s.ChannelLora.Enable {
+		switch s.ChannelLora.Bandwidth {
+		case 125000, 250000, 500000:
+		default:
+			v.fail("chan_Lora_std.bandwidth", s.ChannelLora.Bandwidth, "must be 125000, 250000 or 500000")
+		}
+		if s.ChannelLora.SpreadingFactor < 5 || s.ChannelLora.SpreadingFactor > 12 {
+			v.fail("chan_Lora_std.spread_factor", s.ChannelLora.SpreadingFactor, "must be 5 to 12")
+		}
+	}
+
+	if s.ChannelFSK.Enable && s.ChannelFSK.Datarate <= 0 {
+		v.fail("chan_FSK.datarate", s.ChannelFSK.Datarate, "enabled FSK channel has no datarate")
+	}
+
+	if s.ChannelMultiSF != nil {
+		for _, sf := range s.ChannelMultiSF.SpreadingFactors {
+			if sf < 5 || sf > 12 {
+				v.fail("chan_multiSF_All.spreading_factor_enable", sf, "must be 5 to 12")
+			}
+		}
+	}
+
+	for _, c := range s.channels() {
+		if !c.ch.Enable {
+			continue
+		}
+		if c.ch.Radio >= uint(len(radios)) {
+			v.fail(c.name+".radio", c.ch.Radio, "board has radios 0 and 1 only")
+			continue
+		}
+		if !radios[c.ch.Radio].Enable {
+			v.fail(c.name+".radio", c.ch.Radio, "radio is disabled")
+		}
+		bw := c.bw
+		if bw == 0 {
+			bw = 125000
+		}
+		if limit := maxIF(bw); c.ch.IF > limit || c.ch.IF < -limit {
+			v.fail(c.name+".if", c.ch.IF, "outside the ±%d Hz window of a %d Hz channel", limit, bw)
+		}
+	}
+}
+
+// validateFreqRange checks radios and channels are inside the frequency range
+func (s SX1301) validateFreqRange(v *validator, freqRange []uint) {
+	inRange := func(f int) bool {
+		return f >= int(freqRange[0]) && f <= int(freqRange[1])
+	}
+
+	radios := []Radio{s.Radio0, s.Radio1}
+	for i, r := range radios {
+		if r.Enable && r.Freq != 0 && !inRange(int(r.Freq)) {
+			v.fail(fmt.Sprintf("radio_%d.freq", i), r.Freq, "outside freq_range %v", freqRange)
+		}
+	}
+
+	for _, c := range s.channels() {
+		if !c.ch.Enable || c.ch.Radio >= uint(len(radios)) || radios[c.ch.Radio].Freq == 0 {
+			continue
+		}
+		if f := int(radios[c.ch.Radio].Freq) + c.ch.IF; !inRange(f) {
+			v.fail(c.name+".if", c.ch.IF, "channel at %d Hz outside freq_range %v", f, freqRange)
+		}
+	}
+}